@@ -0,0 +1,67 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "sync"
+
+// powerWindow holds the last POWER_AVERAGE values of one power path, oldest overwritten
+// first
+type powerWindow struct {
+	values []float64
+	next   int
+}
+
+var (
+	averageMu    sync.Mutex
+	powerWindows = map[string]*powerWindow{}
+)
+
+// averagePower adds value to the window of path and returns the average over it. Only
+// what is published is averaged, the session energy and everything else calculated from
+// the power still uses every update as it came.
+func averagePower(path string, value float64) float64 {
+	if cfg.PowerAverage <= 1 {
+		return value
+	}
+	averageMu.Lock()
+	defer averageMu.Unlock()
+	w, ok := powerWindows[path]
+	if !ok {
+		w = &powerWindow{values: make([]float64, 0, cfg.PowerAverage)}
+		powerWindows[path] = w
+	}
+	if len(w.values) < cfg.PowerAverage {
+		w.values = append(w.values, value)
+	} else {
+		w.values[w.next] = value
+		w.next = (w.next + 1) % cfg.PowerAverage
+	}
+
+	// Summed up again every time, a running sum would drift with the float rounding
+	var sum float64
+	for _, v := range w.values {
+		sum += v
+	}
+	return sum / float64(len(w.values))
+}
+
+// resetAverages starts all windows over, after a gap in the updates the old values say
+// nothing about the current power
+func resetAverages() {
+	averageMu.Lock()
+	powerWindows = map[string]*powerWindow{}
+	averageMu.Unlock()
+}
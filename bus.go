@@ -0,0 +1,161 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// busMu guards conn, which is replaced when the connection to dbus is lost and made again
+var busMu sync.RWMutex
+
+// busConn is the current dbus connection, nil with NO_DBUS or while reconnecting
+func busConn() *dbus.Conn {
+	busMu.RLock()
+	defer busMu.RUnlock()
+	return conn
+}
+
+// systemBusSocket is where the system bus is, unless DBUS_SYSTEM_BUS_ADDRESS says otherwise
+const systemBusSocket = "/var/run/dbus/system_bus_socket"
+
+// dialBus opens a new connection to DBUS_BUS. Not the shared one from dbus.SystemBus(),
+// which would keep handing out the same connection after it broke.
+func dialBus() (*dbus.Conn, error) {
+	if cfg.Bus != "session" && os.Getenv("DBUS_SYSTEM_BUS_ADDRESS") == "" {
+		if _, err := os.Stat(systemBusSocket); err != nil {
+			hint := ""
+			if inContainer() {
+				hint = ", mount it into the container (docker run -v /var/run/dbus:/var/run/dbus)"
+			}
+			return nil, fmt.Errorf("the system bus socket %s is missing%s, or set NO_DBUS=true to run without dbus", systemBusSocket, hint)
+		}
+	}
+
+	var c *dbus.Conn
+	var err error
+	if cfg.Bus == "session" {
+		c, err = dbus.SessionBusPrivate()
+	} else {
+		c, err = dbus.SystemBusPrivate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Auth(nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.Hello(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connectDBus connects to dbus and registers the meter on it
+func connectDBus(role meterRole, basicPaths, updatingPaths []dbus.ObjectPath) error {
+	c, err := dialBus()
+	if err != nil {
+		return fmt.Errorf("could not connect to the %s dbus: %v", cfg.Bus, err)
+	}
+	if err := registerDBus(c, role, basicPaths, updatingPaths); err != nil {
+		c.Close()
+		return err
+	}
+	busMu.Lock()
+	conn = c
+	busMu.Unlock()
+	return nil
+}
+
+// watchBus connects and registers again whenever the connection to dbus is lost, e.g.
+// when dbus-daemon restarts during a firmware update. Until then, nothing is sent.
+func watchBus(role meterRole, basicPaths, updatingPaths []dbus.ObjectPath) {
+	for {
+		c := busConn()
+		if c == nil {
+			return
+		}
+		<-c.Context().Done()
+
+		busMu.Lock()
+		if conn != c {
+			// shutdown closed it
+			busMu.Unlock()
+			return
+		}
+		conn = nil
+		busMu.Unlock()
+		log.Warn("Lost the connection to dbus, reconnecting")
+
+		delay := time.Second
+		for {
+			time.Sleep(delay)
+			err := connectDBus(role, basicPaths, updatingPaths)
+			if err == nil {
+				break
+			}
+			log.Warn("Reconnecting to dbus failed: ", err)
+			if delay < 30*time.Second {
+				delay *= 2
+			}
+		}
+		log.Info("Reconnected to dbus as ", serviceName)
+	}
+}
+
+// After this many signals in a row couldn't be sent, the connection is taken as broken
+// and closed, so watchBus connects again
+const emitFailLimit = 10
+
+var (
+	emitMu       sync.Mutex
+	emitFailures int
+	emitWarned   time.Time
+)
+
+// emitSignal sends a signal on c. Failures are logged at most once a minute, so a bus
+// which is overloaded for a while doesn't flood the log, and end in a new connection if
+// they persist. Otherwise decoding would go on with nothing reaching the GX device.
+func emitSignal(c *dbus.Conn, path dbus.ObjectPath, name string, values interface{}) {
+	err := c.Emit(path, name, values)
+
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	if err == nil {
+		if emitFailures > 0 {
+			log.Infof("dbus signals are sent again, after %d failed", emitFailures)
+			emitFailures = 0
+		}
+		return
+	}
+	emitFailures++
+	if time.Since(emitWarned) >= time.Minute {
+		log.Warnf("Could not send %s for %s: %v", name, path, err)
+		emitWarned = time.Now()
+	}
+	if emitFailures == emitFailLimit {
+		log.Warnf("%d dbus signals in a row failed, connecting again", emitFailLimit)
+		c.Close()
+	}
+}
@@ -0,0 +1,340 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"os/exec"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+// startBus runs a private dbus-daemon for the test and points DBUS_BUS=session at it.
+// Tests using it are skipped where dbus-daemon isn't installed.
+func startBus(t *testing.T) {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatal("dbus-daemon didn't tell its address: ", err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", strings.TrimSpace(address))
+	t.Setenv("DBUS_BUS", "session")
+}
+
+// startService registers the meter on a private bus, as main does, and returns a client
+// connection to the same bus
+func startService(t *testing.T) (client *dbus.Conn, basicPaths, updatingPaths []dbus.ObjectPath) {
+	t.Helper()
+	startBus(t)
+	resetState(t)
+	basicPaths, updatingPaths = setupValues(roles[cfg.Role])
+	client = newClient(t)
+	registerService(t, basicPaths, updatingPaths)
+	return client, basicPaths, updatingPaths
+}
+
+// registerService connects the meter to the bus, until the test ends
+func registerService(t *testing.T, basicPaths, updatingPaths []dbus.ObjectPath) {
+	t.Helper()
+	if err := connectDBus(roles[cfg.Role], basicPaths, updatingPaths); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		busMu.Lock()
+		c := conn
+		conn = nil
+		busMu.Unlock()
+		if c != nil {
+			c.Close()
+		}
+	})
+}
+
+// newClient connects to the private bus as a consumer of the meter would
+func newClient(t *testing.T) *dbus.Conn {
+	t.Helper()
+	client, err := dbus.SessionBusPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if err := client.Auth(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Hello(); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestRegisterDBus(t *testing.T) {
+	client, basicPaths, updatingPaths := startService(t)
+
+	var owned bool
+	if err := client.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, serviceName).Store(&owned); err != nil {
+		t.Fatal(err)
+	}
+	if !owned {
+		t.Fatalf("%s has no owner", serviceName)
+	}
+
+	var items map[string]map[string]dbus.Variant
+	if err := client.Object(serviceName, "/").Call("com.victronenergy.BusItem.GetItems", 0).Store(&items); err != nil {
+		t.Fatal(err)
+	}
+	var got, want []string
+	for p := range items {
+		got = append(got, p)
+	}
+	for _, p := range append(basicPaths, updatingPaths...) {
+		want = append(want, string(p))
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("GetItems returned\n%v\nbut the registered paths are\n%v", got, want)
+	}
+}
+
+// introspectPath introspects path of the service, with ok false if it has no introspection
+func introspectPath(t *testing.T, client *dbus.Conn, path dbus.ObjectPath) (node introspect.Node, ok bool) {
+	t.Helper()
+	var data string
+	if err := client.Object(serviceName, path).Call("org.freedesktop.DBus.Introspectable.Introspect", 0).Store(&data); err != nil {
+		return node, false
+	}
+	if err := xml.Unmarshal([]byte(data), &node); err != nil {
+		t.Fatalf("introspection of %s: %v", path, err)
+	}
+	return node, true
+}
+
+// children lists the names of the nodes below node
+func children(node introspect.Node) []string {
+	var names []string
+	for _, c := range node.Children {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestIntrospect(t *testing.T) {
+	client, _, _ := startService(t)
+
+	leaf, ok := introspectPath(t, client, "/Ac/L1/Power")
+	if !ok {
+		t.Fatal("no introspection on /Ac/L1/Power")
+	}
+	var busItem bool
+	for _, i := range leaf.Interfaces {
+		if i.Name == "com.victronenergy.BusItem" {
+			busItem = true
+		}
+	}
+	if !busItem {
+		t.Error("/Ac/L1/Power doesn't list com.victronenergy.BusItem")
+	}
+
+	node, ok := introspectPath(t, client, "/Ac/L1")
+	if !ok {
+		t.Fatal("no introspection on /Ac/L1")
+	}
+	if got := strings.Join(children(node), " "); got != "ApparentPower Current Energy Power PowerFactor ReactivePower Voltage" {
+		t.Errorf("/Ac/L1 lists %s", got)
+	}
+
+	// A phase without energy counters loses them, and the node leading only to them
+	unexport("/Ac/L1/Energy/Forward")
+	unexport("/Ac/L1/Energy/Reverse")
+	// godbus still answers for it, but with nothing below
+	if node, _ := introspectPath(t, client, "/Ac/L1/Energy"); len(node.Children) > 0 {
+		t.Errorf("/Ac/L1/Energy still lists %v", children(node))
+	}
+	node, _ = introspectPath(t, client, "/Ac/L1")
+	for _, c := range children(node) {
+		if c == "Energy" {
+			t.Error("/Ac/L1 still lists Energy")
+		}
+	}
+}
+
+func TestSignals(t *testing.T) {
+	client, _, _ := startService(t)
+	if err := client.AddMatchSignal(dbus.WithMatchInterface("com.victronenergy.BusItem")); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *dbus.Signal, 1000)
+	client.Signal(signals)
+
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b), b)
+
+	var properties, items bool
+	timeout := time.After(5 * time.Second)
+	for !properties || !items {
+		var s *dbus.Signal
+		select {
+		case s = <-signals:
+		case <-timeout:
+			t.Fatalf("PropertiesChanged on /Ac/Power sent: %v, ItemsChanged sent: %v", properties, items)
+		}
+		if len(s.Body) != 1 {
+			t.Fatalf("%s on %s has %d arguments, want 1", s.Name, s.Path, len(s.Body))
+		}
+
+		var emit map[string]dbus.Variant
+		switch {
+		case s.Name == "com.victronenergy.BusItem.PropertiesChanged" && s.Path == "/Ac/Power":
+			// What dbus-systemcalc's handler unpacks: a{sv} with Value and Text
+			if sig := dbus.SignatureOf(s.Body[0]).String(); sig != "a{sv}" {
+				t.Fatalf("PropertiesChanged carries %s, want a{sv}", sig)
+			}
+			emit = s.Body[0].(map[string]dbus.Variant)
+			properties = true
+		case s.Name == "com.victronenergy.BusItem.ItemsChanged":
+			if s.Path != "/" {
+				t.Errorf("ItemsChanged sent from %s, want /", s.Path)
+			}
+			if sig := dbus.SignatureOf(s.Body[0]).String(); sig != "a{sa{sv}}" {
+				t.Fatalf("ItemsChanged carries %s, want a{sa{sv}}", sig)
+			}
+			var ok bool
+			if emit, ok = s.Body[0].(map[string]map[string]dbus.Variant)["/Ac/Power"]; !ok {
+				// e.g. /Serial, changed before the values of the update
+				continue
+			}
+			items = true
+		default:
+			continue
+		}
+		if v, _ := emit["Value"].Value().(float64); !near(v, 2345.6) {
+			t.Errorf("%s has Value %v, want 2345.6", s.Name, emit["Value"])
+		}
+		if text, _ := emit["Text"].Value().(string); text != "2345.60W" {
+			t.Errorf("%s has Text %v, want 2345.60W", s.Name, emit["Text"])
+		}
+	}
+}
+
+func TestRootObject(t *testing.T) {
+	client, _, _ := startService(t)
+	root := client.Object(serviceName, "/")
+
+	rootValues := func() (map[string]dbus.Variant, map[string]string) {
+		t.Helper()
+		var values map[string]dbus.Variant
+		if err := root.Call("com.victronenergy.BusItem.GetValue", 0).Store(&values); err != nil {
+			t.Fatal("GetValue on /: ", err)
+		}
+		var texts map[string]string
+		if err := root.Call("com.victronenergy.BusItem.GetText", 0).Store(&texts); err != nil {
+			t.Fatal("GetText on /: ", err)
+		}
+		return values, texts
+	}
+
+	// Before the first update the values are there, the placeholders as invalid
+	values, texts := rootValues()
+	if name, _ := values["ProductName"].Value().(string); name != cfg.ProductName {
+		t.Errorf("ProductName %v, want %q", values["ProductName"], cfg.ProductName)
+	}
+	if texts["ProductName"] != cfg.ProductName {
+		t.Errorf("ProductName text %q, want %q", texts["ProductName"], cfg.ProductName)
+	}
+	if invalid, ok := values["Ac/Power"].Value().([]int32); !ok || len(invalid) != 0 {
+		t.Errorf("Ac/Power %v before the first update, want an empty array", values["Ac/Power"])
+	}
+
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b), b)
+	values, texts = rootValues()
+	if v, _ := values["Ac/Power"].Value().(float64); !near(v, 2345.6) {
+		t.Errorf("Ac/Power %v, want 2345.6", values["Ac/Power"])
+	}
+	if texts["Ac/Power"] != "2345.60W" {
+		t.Errorf("Ac/Power text %q, want 2345.60W", texts["Ac/Power"])
+	}
+
+	var items map[string]map[string]dbus.Variant
+	if err := root.Call("com.victronenergy.BusItem.GetItems", 0).Store(&items); err != nil {
+		t.Fatal("GetItems on /: ", err)
+	}
+	if v, _ := items["/Ac/Power"]["Value"].Value().(float64); !near(v, 2345.6) {
+		t.Errorf("GetItems has /Ac/Power %v, want 2345.6", items["/Ac/Power"])
+	}
+}
+
+func TestGetItemsWhileRegistering(t *testing.T) {
+	startBus(t)
+	resetState(t)
+	basicPaths, updatingPaths := setupValues(roles[cfg.Role])
+	client := newClient(t)
+	name := serviceBusName(roles[cfg.Role], cfg.DeviceInstance)
+
+	// A consumer asks as soon as it can, the first answer it gets must be complete
+	first := make(chan map[string]map[string]dbus.Variant, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var items map[string]map[string]dbus.Variant
+			if err := client.Object(name, "/").Call("com.victronenergy.BusItem.GetItems", 0).Store(&items); err == nil {
+				first <- items
+				return
+			}
+		}
+	}()
+
+	registerService(t, basicPaths, updatingPaths)
+	var items map[string]map[string]dbus.Variant
+	select {
+	case items = <-first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetItems never answered")
+	}
+	for _, p := range append(basicPaths, updatingPaths...) {
+		if _, ok := items[string(p)]; !ok {
+			t.Errorf("%s missing from the first GetItems", p)
+		}
+	}
+}
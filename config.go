@@ -0,0 +1,556 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+)
+
+// config holds everything which can be tuned through environment variables
+type config struct {
+	Serial             uint32             // SERIAL: only follow the meter with this serial number
+	SusyID             uint16             // SMASUSYID: only follow devices of this SUSy ID (device class)
+	Meters             []meterEntry       // METERS: serial:deviceinstance pairs, to follow several meters at once
+	NoDBus             bool               // NO_DBUS: don't touch dbus at all, only log what is decoded
+	Bus                string             // DBUS_BUS: system, or session to try it on a development machine
+	Role               string             // ROLE: what Venus uses the meter for, one of the keys of roles
+	Position           int                // POSITION: where a pvinverter is connected, 0 AC input 1, 1 AC output, 2 AC input 2
+	DBusName           string             // DBUS_NAME: full dbus service name instead of <role service>.cgwacs_ttyUSB0_di<instance>_mb1
+	DeviceInstance     int                // DEVICE_INSTANCE: VRM device instance, also part of the dbus name
+	InstanceConflict   string             // DEVICE_INSTANCE_CONFLICT: next takes the next free instance when DEVICE_INSTANCE is used, warn only logs it
+	CustomName         string             // CUSTOM_NAME: name shown for the meter in the GUI
+	ProductName        string             // PRODUCT_NAME: product the meter claims to be
+	DeviceType         int                // DEVICE_TYPE: meter type published on /DeviceType
+	ProductID          uint16             // PRODUCT_ID: Victron product id, decimal or 0x hex
+	Phases             int                // PHASES: number of phases connected, 2 for split-phase services
+	PublishPhases      bool               // PUBLISH_PHASES: false publishes only the totals, no /Ac/Lx paths
+	CurrentTotal       string             // CURRENT_TOTAL_MODE: sum of the phases, or the meter's own total if it sends one
+	InvertCurrent      bool               // INVERT_CURRENT: publish currents negative when buying
+	InvertPower        bool               // INVERT_POWER: publish active power negative when buying
+	MaxPower           int                // MAX_POWER: nominal rating in W published on /Ac/MaxPower, 0 leaves it out
+	EnergyCounters     bool               // ENERGY_COUNTERS: false for sources without energy counters, leaves out their paths
+	EnergyRaw          bool               // ENERGY_RAW: also publish the energy counters in Ws as the meter sent them
+	EnergyDelta        bool               // ENERGY_DELTA: also publish the Wh counted since the previous update
+	EnergyMax          float64            // ENERGY_MAX: highest plausible energy counter in kWh
+	EnergyMaxStep      float64            // ENERGY_MAX_STEP: most a counter may grow between two updates in kWh
+	PhaseScales        []float64          // POWER_SCALE_L1 to POWER_SCALE_L3: calibration factors for the phases' CTs
+	PowerAverage       int                // POWER_AVERAGE: number of updates the published power is averaged over, 1 for none
+	EnergyCheckPercent float64            // ENERGY_CHECK_PERCENT: warn when the counters and the integrated power differ by more, 0 disables
+	Decimals           map[string]int     // DECIMALS: decimals of the texts by unit, e.g. W=0,kWh=3; ENERGY_DECIMALS for kWh alone
+	EnergyOffsets      map[string]float64 // ENERGY_FORWARD_OFFSET, ENERGY_REVERSE_OFFSET: kWh subtracted from the totals, by path
+	StateFile          string             // STATE_FILE: keep the energy counters here across restarts
+	StateInterval      time.Duration      // STATE_INTERVAL: seconds between saving the energy counters
+	Signals            string             // DBUS_SIGNALS: both, items (ItemsChanged only) or properties (PropertiesChanged only)
+	PublishInterval    time.Duration      // PUBLISH_INTERVAL: milliseconds to collect changes before signalling them, 0 sends right away
+	NameAttempts       int                // DBUS_NAME_ATTEMPTS: how often to try getting the dbus name before giving up
+	HeartbeatInterval  time.Duration      // HEARTBEAT_INTERVAL: seconds of dbus silence before re-announcing, 0 disables
+	StaleTimeout       time.Duration      // STALE_TIMEOUT: seconds without meter data before /Connected drops to 0, 0 disables
+	ReplayFile         string             // REPLAY_FILE: read datagrams from this capture instead of the network
+	ReplayTiming       bool               // REPLAY_TIMING: keep the original gaps between replayed datagrams
+	CaptureFile        string             // CAPTURE_FILE: append every received datagram to this file
+	StatsInterval      time.Duration      // STATS_INTERVAL: seconds between logging the datagram counters, 0 disables
+	MetricsAddr        string             // METRICS_ADDR: serve prometheus metrics on this address, e.g. :9100
+	StatusAddr         string             // STATUS_ADDR: serve the current values as JSON on this address
+	GRPCAddr           string             // GRPC_ADDR: stream the meter updates to gRPC clients on this address
+	MQTTBroker         string             // MQTT_BROKER: host:port of an MQTT broker to publish the values to
+	MQTTTopic          string             // MQTT_TOPIC: prefix of all topics published
+	MQTTClientID       string             // MQTT_CLIENT_ID: client id used with the broker
+	MQTTUser           string             // MQTT_USER
+	MQTTPassword       string             // MQTT_PASSWORD
+	MQTTDiscovery      string             // MQTT_DISCOVERY_PREFIX: where Home Assistant looks for discovery, "" with MQTT_DISCOVERY=false
+	MQTTEnergyInterval time.Duration      // MQTT_ENERGY_INTERVAL: seconds between publishing the energy counters
+	Source             string             // SOURCE: speedwire (the meter's multicast) or modbus
+	MeterType          string             // METER_TYPE: sma, or em24 to poll a Carlo Gavazzi EM24 over Modbus TCP
+	ModbusAddr         string             // MODBUS_ADDR: host:port of the SMA device to poll with SOURCE=modbus
+	ModbusUnit         byte               // MODBUS_UNIT: Modbus unit id, SMA devices use 3
+	ModbusInterval     time.Duration      // MODBUS_INTERVAL: seconds between polls
+	MulticastAddress   string             // MULTICAST_ADDR: group and port the meter sends its updates to
+	Interface          string             // INTERFACE: network interface to receive the meter's multicast on
+	MulticastLoop      *bool              // MULTICAST_LOOP: whether generate's updates reach this host too, nil keeps the system default
+	MulticastTTL       int                // MULTICAST_TTL: routers generate's updates may cross, 0 keeps the system default
+	RejoinTimeout      time.Duration      // REJOIN_TIMEOUT: seconds without any datagram before joining the group again, 0 disables
+}
+
+var cfg config
+
+func loadConfig() config {
+	c := config{}
+
+	c.Serial = uint32(envUint("SERIAL", 0, 32))
+	susyID := envUint("SMASUSYID", 0, 32)
+	if susyID > 0xffff {
+		// Before SERIAL existed, SMASUSYID was compared against the serial number
+		log.Warn("SMASUSYID holds a serial number, please use SERIAL instead")
+		if c.Serial == 0 {
+			c.Serial = uint32(susyID)
+		}
+	} else {
+		c.SusyID = uint16(susyID)
+	}
+
+	meters, err := parseMeters(os.Getenv("METERS"))
+	if err != nil {
+		log.Warn("Ignoring METERS: ", err)
+	}
+	c.Meters = meters
+
+	c.NoDBus = envBool("NO_DBUS", false)
+
+	c.PublishPhases = envBool("PUBLISH_PHASES", true)
+
+	c.Position = envInt("POSITION", 0)
+	if c.Position < 0 || c.Position > 2 {
+		log.Warnf("POSITION must be 0, 1 or 2, not %d, using 0", c.Position)
+		c.Position = 0
+	}
+
+	c.Bus = envString("DBUS_BUS", "system")
+	if c.Bus != "system" && c.Bus != "session" {
+		log.Warnf("Unknown DBUS_BUS %q, using the system bus", c.Bus)
+		c.Bus = "system"
+	}
+
+	c.Role = envString("ROLE", "grid")
+	if _, ok := roles[c.Role]; !ok {
+		log.Warnf("Unknown ROLE %q, running as a grid meter", c.Role)
+		c.Role = "grid"
+	}
+
+	c.DBusName = os.Getenv("DBUS_NAME")
+	if c.DBusName != "" && !validDBusName(c.DBusName, roles[c.Role].service) {
+		log.Warnf("DBUS_NAME %q must be a valid name below %s, using the default", c.DBusName, roles[c.Role].service)
+		c.DBusName = ""
+	}
+
+	c.DeviceInstance = envInt("DEVICE_INSTANCE", 30)
+	if c.DeviceInstance < 0 || c.DeviceInstance > 255 {
+		log.Warn("DEVICE_INSTANCE must be between 0 and 255, using 30 instead of ", c.DeviceInstance)
+		c.DeviceInstance = 30
+	}
+
+	c.InstanceConflict = envString("DEVICE_INSTANCE_CONFLICT", "next")
+	if c.InstanceConflict != "next" && c.InstanceConflict != "warn" {
+		log.Warnf("Unknown DEVICE_INSTANCE_CONFLICT %q, taking the next free instance", c.InstanceConflict)
+		c.InstanceConflict = "next"
+	}
+
+	c.CustomName = envString("CUSTOM_NAME", "Grid meter")
+	c.ProductName = envString("PRODUCT_NAME", "Grid meter")
+
+	// What the role announces by default, see roles
+	c.DeviceType = envInt("DEVICE_TYPE", roles[c.Role].deviceType)
+	c.ProductID = roles[c.Role].productID
+	if s := os.Getenv("PRODUCT_ID"); s != "" {
+		if id, err := strconv.ParseUint(s, 0, 16); err != nil {
+			log.Warnf("Could not parse PRODUCT_ID=%q as a number, using 0x%04x", s, c.ProductID)
+		} else {
+			c.ProductID = uint16(id)
+		}
+	}
+
+	c.Phases = envInt("PHASES", 3)
+	if c.Phases < 1 || c.Phases > 3 {
+		log.Warn("PHASES must be 1, 2 or 3, using 3 instead of ", c.Phases)
+		c.Phases = 3
+	}
+
+	c.CurrentTotal = envString("CURRENT_TOTAL_MODE", "sum")
+	if c.CurrentTotal != "sum" && c.CurrentTotal != "meter" {
+		log.Warnf("Unknown CURRENT_TOTAL_MODE %q, using the sum of the phases", c.CurrentTotal)
+		c.CurrentTotal = "sum"
+	}
+
+	c.InvertCurrent = envBool("INVERT_CURRENT", false)
+	c.InvertPower = envBool("INVERT_POWER", false)
+
+	c.MaxPower = envInt("MAX_POWER", 0)
+	if c.MaxPower < 0 {
+		log.Warn("MAX_POWER can't be negative, leaving it out")
+		c.MaxPower = 0
+	}
+
+	c.EnergyCounters = envBool("ENERGY_COUNTERS", true)
+	c.EnergyRaw = envBool("ENERGY_RAW", false)
+	c.EnergyDelta = envBool("ENERGY_DELTA", false)
+	c.EnergyMax = envFloat("ENERGY_MAX", 10000000)
+	c.EnergyMaxStep = envFloat("ENERGY_MAX_STEP", 10)
+
+	for _, phase := range phaseNames {
+		scale := envFloat("POWER_SCALE_"+phase, 1)
+		if scale <= 0 {
+			log.Warnf("POWER_SCALE_%s must be above 0, using 1", phase)
+			scale = 1
+		}
+		c.PhaseScales = append(c.PhaseScales, scale)
+	}
+
+	c.PowerAverage = envInt("POWER_AVERAGE", 1)
+	if c.PowerAverage < 1 {
+		log.Warn("POWER_AVERAGE must be at least 1, not averaging")
+		c.PowerAverage = 1
+	}
+
+	c.EnergyCheckPercent = envFloat("ENERGY_CHECK_PERCENT", 10)
+
+	// The raw energy counters are whole Ws
+	c.Decimals = map[string]int{"Ws": 0}
+	if d := envInt("ENERGY_DECIMALS", 2); d >= 0 && d <= 6 {
+		c.Decimals["kWh"] = d
+	} else {
+		log.Warn("ENERGY_DECIMALS must be 0 to 6, using 2")
+	}
+	for _, item := range strings.Split(os.Getenv("DECIMALS"), ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		d, err := strconv.Atoi(strings.TrimSpace(parts[len(parts)-1]))
+		if len(parts) != 2 || err != nil || d < 0 || d > 6 {
+			log.Warnf("Ignoring %q in DECIMALS, expected unit=decimals with 0 to 6 decimals", item)
+			continue
+		}
+		c.Decimals[strings.TrimSpace(parts[0])] = d
+	}
+
+	c.EnergyOffsets = map[string]float64{}
+	for path, name := range map[string]string{
+		"/Ac/Energy/Forward": "ENERGY_FORWARD_OFFSET",
+		"/Ac/Energy/Reverse": "ENERGY_REVERSE_OFFSET",
+	} {
+		if offset := envFloat(name, 0); offset != 0 {
+			c.EnergyOffsets[path] = offset
+		}
+	}
+
+	c.StateFile = os.Getenv("STATE_FILE")
+	c.StateInterval = time.Duration(envInt("STATE_INTERVAL", 300)) * time.Second
+	if c.StateInterval < time.Second {
+		c.StateInterval = 300 * time.Second
+	}
+
+	c.Signals = envString("DBUS_SIGNALS", "both")
+	if c.Signals != "both" && c.Signals != "items" && c.Signals != "properties" {
+		log.Warnf("Unknown DBUS_SIGNALS %q, sending both", c.Signals)
+		c.Signals = "both"
+	}
+
+	c.PublishInterval = time.Duration(envInt("PUBLISH_INTERVAL", 0)) * time.Millisecond
+	if c.PublishInterval < 0 {
+		c.PublishInterval = 0
+	}
+
+	c.NameAttempts = envInt("DBUS_NAME_ATTEMPTS", 5)
+	if c.NameAttempts < 1 {
+		c.NameAttempts = 1
+	}
+
+	c.HeartbeatInterval = time.Duration(envInt("HEARTBEAT_INTERVAL", 10)) * time.Second
+	c.StaleTimeout = time.Duration(envInt("STALE_TIMEOUT", 5)) * time.Second
+
+	c.ReplayFile = os.Getenv("REPLAY_FILE")
+	c.ReplayTiming = envBool("REPLAY_TIMING", false)
+	c.CaptureFile = os.Getenv("CAPTURE_FILE")
+
+	c.StatsInterval = time.Duration(envInt("STATS_INTERVAL", 3600)) * time.Second
+	c.MetricsAddr = os.Getenv("METRICS_ADDR")
+	c.StatusAddr = os.Getenv("STATUS_ADDR")
+	c.GRPCAddr = os.Getenv("GRPC_ADDR")
+	c.MQTTBroker = os.Getenv("MQTT_BROKER")
+	c.MQTTTopic = strings.TrimSuffix(envString("MQTT_TOPIC", fmt.Sprintf("shm-et340/%d", c.DeviceInstance)), "/")
+	c.MQTTClientID = envString("MQTT_CLIENT_ID", fmt.Sprintf("shm-et340-%d", c.DeviceInstance))
+	c.MQTTUser = os.Getenv("MQTT_USER")
+	c.MQTTPassword = os.Getenv("MQTT_PASSWORD")
+	if envBool("MQTT_DISCOVERY", true) {
+		c.MQTTDiscovery = envString("MQTT_DISCOVERY_PREFIX", "homeassistant")
+	}
+	c.MQTTEnergyInterval = time.Duration(envInt("MQTT_ENERGY_INTERVAL", 60)) * time.Second
+
+	c.Source = envString("SOURCE", "speedwire")
+	if c.Source != "speedwire" && c.Source != "modbus" {
+		log.Warnf("Unknown SOURCE %q, using speedwire", c.Source)
+		c.Source = "speedwire"
+	}
+	c.ModbusAddr = os.Getenv("MODBUS_ADDR")
+	if c.ModbusAddr != "" && !strings.Contains(c.ModbusAddr, ":") {
+		c.ModbusAddr += ":502"
+	}
+	if c.Source == "modbus" && c.ModbusAddr == "" {
+		log.Warn("SOURCE=modbus needs MODBUS_ADDR, using speedwire")
+		c.Source = "speedwire"
+	}
+	c.MeterType = envString("METER_TYPE", "sma")
+	if c.MeterType != "sma" && c.MeterType != "em24" {
+		log.Warnf("Unknown METER_TYPE %q, using sma", c.MeterType)
+		c.MeterType = "sma"
+	}
+	if c.MeterType == "em24" {
+		if c.ModbusAddr == "" {
+			log.Warn("METER_TYPE=em24 needs MODBUS_ADDR, using sma")
+			c.MeterType = "sma"
+		} else {
+			// The EM24 only speaks Modbus
+			c.Source = "modbus"
+		}
+	}
+	// SMA devices answer as unit 3, the EM24 as 1
+	unit := uint64(3)
+	if c.MeterType == "em24" {
+		unit = 1
+	}
+	c.ModbusUnit = byte(envUint("MODBUS_UNIT", unit, 8))
+	c.ModbusInterval = time.Duration(envInt("MODBUS_INTERVAL", 1)) * time.Second
+	if c.ModbusInterval < time.Second {
+		c.ModbusInterval = time.Second
+	}
+
+	c.MulticastAddress = envString("MULTICAST_ADDR", "239.12.255.254:9522")
+	c.Interface = os.Getenv("INTERFACE")
+	if _, ok := os.LookupEnv("MULTICAST_LOOP"); ok {
+		loop := envBool("MULTICAST_LOOP", true)
+		c.MulticastLoop = &loop
+	}
+	c.MulticastTTL = envInt("MULTICAST_TTL", 0)
+	if c.MulticastTTL < 0 || c.MulticastTTL > 255 {
+		log.Warn("MULTICAST_TTL must be 1 to 255, keeping the system default")
+		c.MulticastTTL = 0
+	}
+	c.RejoinTimeout = time.Duration(envInt("REJOIN_TIMEOUT", 60)) * time.Second
+
+	return c
+}
+
+// settings are the names the config file may set, the environment variables read by
+// loadConfig and the log setup
+var settings = []string{
+	"SERIAL", "SMASUSYID", "METERS", "NO_DBUS", "DBUS_BUS", "ROLE", "POSITION", "DBUS_NAME",
+	"DEVICE_INSTANCE", "DEVICE_INSTANCE_CONFLICT", "CUSTOM_NAME", "PRODUCT_NAME",
+	"DEVICE_TYPE", "PRODUCT_ID", "PHASES", "PUBLISH_PHASES", "CURRENT_TOTAL_MODE",
+	"INVERT_CURRENT", "INVERT_POWER", "MAX_POWER", "ENERGY_COUNTERS", "ENERGY_RAW",
+	"ENERGY_DELTA", "ENERGY_MAX", "ENERGY_MAX_STEP", "POWER_SCALE_L1", "POWER_SCALE_L2",
+	"POWER_SCALE_L3", "POWER_AVERAGE", "ENERGY_CHECK_PERCENT", "DECIMALS", "ENERGY_DECIMALS",
+	"ENERGY_FORWARD_OFFSET", "ENERGY_REVERSE_OFFSET", "STATE_FILE", "STATE_INTERVAL",
+	"DBUS_SIGNALS", "PUBLISH_INTERVAL", "DBUS_NAME_ATTEMPTS", "HEARTBEAT_INTERVAL",
+	"STALE_TIMEOUT", "REPLAY_FILE", "REPLAY_TIMING", "CAPTURE_FILE", "STATS_INTERVAL",
+	"METRICS_ADDR", "STATUS_ADDR", "GRPC_ADDR", "MQTT_BROKER", "MQTT_TOPIC", "MQTT_CLIENT_ID",
+	"MQTT_USER", "MQTT_PASSWORD", "MQTT_DISCOVERY", "MQTT_DISCOVERY_PREFIX",
+	"MQTT_ENERGY_INTERVAL", "SOURCE", "METER_TYPE", "MODBUS_ADDR", "MODBUS_UNIT",
+	"MODBUS_INTERVAL", "MULTICAST_ADDR", "INTERFACE", "MULTICAST_LOOP", "MULTICAST_TTL",
+	"REJOIN_TIMEOUT", "LOG_LEVEL", "LOG_TIME_FORMAT", "LOG_FILE", "LOG_FILE_SIZE",
+	"LOG_FILE_KEEP",
+}
+
+// environment holds the names set in the process's own environment, which win over the
+// config file
+var environment map[string]bool
+
+// fileSettings tells for every setting taken from the config file where it came from,
+// as "path:line"
+var fileSettings = map[string]string{}
+
+// loadConfigFile puts the settings of the TOML file named by CONFIG_FILE (or -config)
+// into the environment, except for the ones already set there. The keys are the names
+// of the environment variables, e.g. SERIAL = 1900123456 or CUSTOM_NAME = "Garage".
+// Unlike the environment of a running process, this file can be edited and then
+// reloaded with SIGHUP; settings removed from it are dropped then.
+func loadConfigFile() {
+	if environment == nil {
+		environment = map[string]bool{}
+		for _, kv := range os.Environ() {
+			environment[strings.SplitN(kv, "=", 2)[0]] = true
+		}
+	}
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Warn("Could not read CONFIG_FILE: ", err)
+		return
+	}
+	var file map[string]interface{}
+	if err := toml.Unmarshal(data, &file); err != nil {
+		// The parser's message names the key it got to, if any
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			log.Warnf("%s:%d: %v, keeping the previous settings", path, perr.Position.Line, err)
+		} else {
+			log.Warnf("%s: %v, keeping the previous settings", path, err)
+		}
+		return
+	}
+
+	known := map[string]bool{}
+	for _, name := range settings {
+		known[name] = true
+	}
+	lines := strings.Split(string(data), "\n")
+	previous := fileSettings
+	fileSettings = map[string]string{}
+	for key, v := range file {
+		at := fmt.Sprintf("%s:%d", path, keyLine(lines, key))
+		if !known[key] {
+			log.Warnf("%s: unknown setting %s, ignoring it", at, key)
+			continue
+		}
+		var value string
+		switch v := v.(type) {
+		case string:
+			value = v
+		case int64, float64, bool:
+			value = fmt.Sprint(v)
+		default:
+			log.Warnf("%s: %s must be a string, a number or true/false, ignoring it", at, key)
+			continue
+		}
+		if environment[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		fileSettings[key] = at
+	}
+	for key := range previous {
+		if _, ok := fileSettings[key]; !ok {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// keyLine finds the line of the config file setting key, 0 if it can't be told
+func keyLine(lines []string, key string) int {
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, key) && strings.HasPrefix(strings.TrimSpace(line[len(key):]), "=") {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// settingOrigin prefixes warnings about name with the line of the config file it was
+// read from, if it was
+func settingOrigin(name string) string {
+	if at, ok := fileSettings[name]; ok {
+		return at + ": "
+	}
+	return ""
+}
+
+// setLogLevel applies LOG_LEVEL, anything unparseable turns on debug logging
+func setLogLevel() {
+	lvl, ok := os.LookupEnv("LOG_LEVEL")
+	if !ok {
+		lvl = "info"
+	}
+
+	ll, err := log.ParseLevel(lvl)
+	if err != nil {
+		ll = log.DebugLevel
+	}
+
+	log.SetLevel(ll)
+}
+
+// dbusNameElement is one dot separated part of a dbus name
+var dbusNameElement = regexp.MustCompile(`^[A-Za-z_-][A-Za-z0-9_-]*$`)
+
+// validDBusName checks name is a well-formed dbus name below service, e.g.
+// com.victronenergy.grid.something for the grid role
+func validDBusName(name, service string) bool {
+	if len(name) > 255 || !strings.HasPrefix(name, service+".") {
+		return false
+	}
+	for _, element := range strings.Split(strings.TrimPrefix(name, service+"."), ".") {
+		if !dbusNameElement.MatchString(element) {
+			return false
+		}
+	}
+	return true
+}
+
+// envString reads a string from the environment, falling back to def when unset or empty
+func envString(name string, def string) string {
+	if s := os.Getenv(name); s != "" {
+		return s
+	}
+	return def
+}
+
+// envInt reads an integer from the environment, falling back to def when unset or garbage
+func envInt(name string, def int) int {
+	s, ok := os.LookupEnv(name)
+	if !ok || s == "" {
+		return def
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		log.Warnf("%sCould not parse %s=%q as a number, using %d", settingOrigin(name), name, s, def)
+		return def
+	}
+	return v
+}
+
+// envUint reads an unsigned number of the given bit size from the environment
+func envUint(name string, def uint64, bits int) uint64 {
+	s, ok := os.LookupEnv(name)
+	if !ok || s == "" {
+		return def
+	}
+	v, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		log.Warnf("%sCould not parse %s=%q as a number, using %d", settingOrigin(name), name, s, def)
+		return def
+	}
+	return v
+}
+
+// envFloat reads a decimal number from the environment
+func envFloat(name string, def float64) float64 {
+	s, ok := os.LookupEnv(name)
+	if !ok || s == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		log.Warnf("%sCould not parse %s=%q as a number, using %g", settingOrigin(name), name, s, def)
+		return def
+	}
+	return v
+}
+
+// envBool reads a boolean (1/0, true/false, ...) from the environment
+func envBool(name string, def bool) bool {
+	s, ok := os.LookupEnv(name)
+	if !ok || s == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		log.Warnf("%sCould not parse %s=%q as true/false, using %t", settingOrigin(name), name, s, def)
+		return def
+	}
+	return v
+}
@@ -0,0 +1,108 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// useConfigFile writes a config file, and makes loadConfigFile read it with only the
+// test's own environment set. Whatever the file sets is unset when the test ends.
+func useConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "shm-et340.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	environment, fileSettings = nil, map[string]string{}
+	t.Cleanup(func() {
+		for key := range fileSettings {
+			os.Unsetenv(key)
+		}
+		environment, fileSettings = nil, map[string]string{}
+	})
+	return path
+}
+
+// warnings collects what is logged while f runs
+func warnings(f func()) []string {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	f()
+	var messages []string
+	for _, e := range hook.AllEntries() {
+		messages = append(messages, e.Message)
+	}
+	return messages
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Setenv("ROLE", "pvinverter")
+	path := useConfigFile(t, `# A meter on a split-phase service
+PHASES = 2
+ROLE = "acload"
+CUSTOM_NAME = "Garage meter"
+INVERT_POWER = true
+SERAIL = 1900123456
+MAX_POWER = [1, 2]
+`)
+	logged := strings.Join(warnings(loadConfigFile), "\n")
+	c := loadConfig()
+
+	if c.Phases != 2 || c.CustomName != "Garage meter" || !c.InvertPower {
+		t.Errorf("PHASES %d, CUSTOM_NAME %q, INVERT_POWER %v not taken from the file", c.Phases, c.CustomName, c.InvertPower)
+	}
+	if c.Role != "pvinverter" {
+		t.Errorf("ROLE %q, the environment must win over the file", c.Role)
+	}
+	for _, want := range []string{
+		path + ":6: unknown setting SERAIL",
+		path + ":7: MAX_POWER must be a string, a number or true/false",
+	} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("no warning %q, got\n%s", want, logged)
+		}
+	}
+
+	// Syntax errors name the line and key, and leave the settings as they were
+	if err := os.WriteFile(path, []byte("PHASES = 1\nCUSTOM_NAME = Garage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logged = strings.Join(warnings(loadConfigFile), "\n")
+	if !strings.Contains(logged, path+":2: ") || !strings.Contains(logged, "CUSTOM_NAME") {
+		t.Errorf("syntax error doesn't name %s:2 and CUSTOM_NAME, got\n%s", path, logged)
+	}
+	if c := loadConfig(); c.Phases != 2 {
+		t.Errorf("PHASES %d after a broken file, want the previous 2", c.Phases)
+	}
+
+	// Reloading drops what was removed from the file
+	if err := os.WriteFile(path, []byte(`CUSTOM_NAME = "Shed meter"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadConfigFile()
+	c = loadConfig()
+	if c.Phases != 3 || c.InvertPower || c.CustomName != "Shed meter" {
+		t.Errorf("after reloading PHASES %d, INVERT_POWER %v, CUSTOM_NAME %q, want 3, false and Shed meter", c.Phases, c.InvertPower, c.CustomName)
+	}
+}
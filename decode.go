@@ -0,0 +1,104 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// decodeOnce waits for a single meter update and prints everything decoded from it to
+// w, without going near dbus. The output is meant to be pasted into bug reports.
+func decodeOnce(w io.Writer) error {
+	cfg.NoDBus = true
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		// Only what's printed at the end should show up
+		log.SetLevel(log.WarnLevel)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var printed bool
+	handler := func(src *net.UDPAddr, n int, b []byte) {
+		if printed {
+			return
+		}
+		decoded := atomic.LoadUint64(&stats.decoded)
+		msgHandler(src, n, b)
+		if atomic.LoadUint64(&stats.decoded) == decoded {
+			return
+		}
+		printDecoded(w, src)
+		printed = true
+		cancel()
+	}
+
+	if cfg.ReplayFile != "" {
+		err := replay(ctx, cfg.ReplayFile, false, handler)
+		switch {
+		case printed:
+			return nil
+		case err != nil:
+			return fmt.Errorf("replay failed: %w", err)
+		default:
+			return fmt.Errorf("no meter update found in %s", cfg.ReplayFile)
+		}
+	}
+
+	ifi, err := multicastInterface(cfg.Interface)
+	if err != nil {
+		return err
+	}
+	err = listen(ctx, cfg.MulticastAddress, ifi, handler)
+	if printed {
+		return nil
+	}
+	return err
+}
+
+// printDecoded writes the meter's identity and all values below /Ac
+func printDecoded(w io.Writer, src *net.UDPAddr) {
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
+
+	fmt.Fprintln(w, "shm-et340", version)
+	if src != nil {
+		fmt.Fprintln(w, "From:    ", src.IP)
+	}
+	fmt.Fprintln(w, "Serial:  ", meterSerial)
+	fmt.Fprintln(w, "Model:   ", describeModel(meterSusyID))
+	if v, ok := victronValues[1]["/FirmwareVersion"]; ok {
+		fmt.Fprintln(w, "Firmware:", strings.Trim(v.String(), "\""))
+	}
+
+	var paths []string
+	for p := range victronValues[1] {
+		if strings.HasPrefix(string(p), "/Ac/") {
+			paths = append(paths, string(p))
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(w, "%-24s %s\n", p, strings.Trim(victronValues[1][objectpath(p)].String(), "\""))
+	}
+}
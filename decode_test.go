@@ -0,0 +1,57 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestDecodeOnce(t *testing.T) {
+	// decodeOnce quietens the log for its output
+	defer log.SetLevel(log.GetLevel())
+	b := loadFixture(t, "energy-meter.hex")
+	now := time.Now()
+	// Something else on the group first, then two updates of which only the first is printed
+	t.Setenv("REPLAY_FILE", writeCapture(t, [][]byte{b[:40], b, b}, []time.Time{now, now, now}))
+	resetState(t)
+	setupValues(roles[cfg.Role])
+
+	var out bytes.Buffer
+	if err := decodeOnce(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Serial:   1901234567", "/Ac/Power                2345.60W"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("no %q in\n%s", want, out.String())
+		}
+	}
+	if n := strings.Count(out.String(), "Serial:"); n != 1 {
+		t.Errorf("%d updates printed, want 1", n)
+	}
+
+	// Without an update it says so, instead of exiting
+	t.Setenv("REPLAY_FILE", writeCapture(t, [][]byte{b[:40]}, []time.Time{now}))
+	resetState(t)
+	setupValues(roles[cfg.Role])
+	if err := decodeOnce(&out); err == nil || !strings.Contains(err.Error(), "no meter update") {
+		t.Errorf("error %v, want no meter update found", err)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// A Carlo Gavazzi EM24 Ethernet doesn't send any multicast, it answers Modbus TCP like
+// the SMA devices. Its values are signed 32 bit with the low word first, in these units.
+const (
+	em24Voltage       = 0x0000 // L1 to L3 follow, 0.1 V
+	em24Current       = 0x000c // L1 to L3 follow, mA
+	em24PhasePower    = 0x0012 // L1 to L3 follow, 0.1 W
+	em24PhaseApparent = 0x0018 // L1 to L3 follow, 0.1 VA
+	em24PhaseReactive = 0x001e // L1 to L3 follow, 0.1 var
+	em24Power         = 0x0028 // 0.1 W
+	em24Apparent      = 0x002a // 0.1 VA
+	em24Reactive      = 0x002c // 0.1 var
+	em24Frequency     = 0x0033 // a single 16 bit register, 0.1 Hz
+	em24Forward       = 0x0034 // 0.1 kWh
+	em24PhaseForward  = 0x0040 // L1 to L3 follow, 0.1 kWh
+	em24Reverse       = 0x004e // 0.1 kWh
+	em24Serial        = 0x5000 // 7 registers of text, two characters each
+)
+
+// em24Blocks are the register ranges read with each poll, as start and number of 16 bit
+// registers
+var em24Blocks = [][2]uint16{
+	{em24Voltage, em24Forward - em24Voltage},
+	{em24Forward, em24Reverse + 2 - em24Forward},
+	{em24Serial, 7},
+}
+
+// pollEM24 reads the registers of an EM24 once and publishes them like a meter update
+func pollEM24(c net.Conn) error {
+	count(&stats.received)
+	words := map[uint16]uint16{}
+	for _, block := range em24Blocks {
+		values, err := readWords(c, block[0], block[1])
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			words[block[0]+uint16(i)] = v
+		}
+	}
+
+	reg := func(addr uint16, scale float64) float64 {
+		return float64(int32(uint32(words[addr+1])<<16|uint32(words[addr]))) / scale
+	}
+
+	// The EM24's serial is text, it has no number and no SUSy ID
+	serial := make([]byte, 0, 14)
+	for i := uint16(0); i < 7; i++ {
+		w := words[em24Serial+i]
+		serial = append(serial, byte(w>>8), byte(w))
+	}
+	markMeter(strings.TrimRight(string(serial), "\x00 "), 0, 0)
+	r := meterReading{
+		power:     float32(reg(em24Power, 10)),
+		apparent:  float32(reg(em24Apparent, 10)),
+		reactive:  float32(reg(em24Reactive, 10)),
+		forward:   reg(em24Forward, 10),
+		reverse:   reg(em24Reverse, 10),
+		energy:    true,
+		frequency: float64(words[em24Frequency]) / 10,
+		phases:    make([]singlePhase, cfg.Phases),
+	}
+	for i := range r.phases {
+		L := &r.phases[i]
+		at := uint16(2 * i)
+		L.voltage = float32(reg(em24Voltage+at, 10))
+		L.power = float32(reg(em24PhasePower+at, 10))
+		L.apparent = float32(reg(em24PhaseApparent+at, 10))
+		L.reactive = float32(reg(em24PhaseReactive+at, 10))
+		L.pf = powerFactor(L.power, L.apparent)
+		L.forward = reg(em24PhaseForward+at, 10)
+		L.setCurrent(float32(reg(em24Current+at, 1000)))
+	}
+
+	publishReading(r)
+	return nil
+}
+
+// phaseReverseCounted tells whether the meter counts the energy sold per phase. The EM24
+// only counts it in total, so it gets no /Ac/Lx/Energy/Reverse paths.
+func phaseReverseCounted() bool {
+	return cfg.MeterType != "em24"
+}
@@ -0,0 +1,275 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// With ENERGY_RAW, the meter's energy counters are also published as it sent them, in Ws,
+// to compare them with what the SMA app shows without any scaling in between
+const (
+	rawForwardPath = "/Debug/Energy/RawForward"
+	rawReversePath = "/Debug/Energy/RawReverse"
+)
+
+// With ENERGY_DELTA, the Wh counted since the previous update are published for every
+// energy counter on deltaPath(counter), and the seconds between the two updates on
+// deltaIntervalPath, for consumers which sum up their own periods
+const deltaIntervalPath = "/Debug/Energy/DeltaInterval"
+
+var (
+	// counter of the previous update per path in kWh, to take the deltas from
+	deltaBase = map[string]float64{}
+	// when the previous update with energy counters arrived
+	lastDeltaAt time.Time
+)
+
+// How many updates without any per-phase energy before deciding the meter doesn't send it
+const phaseEnergyProbe = 5
+
+// Whether the meter sends per-phase energy counters: unknown while probing, then decided
+var (
+	phaseEnergyKnown   bool
+	phaseEnergyPresent bool
+	phaseEnergyZeros   int
+)
+
+// After this many rejected updates in a row, a counter is assumed to really have been
+// reset (e.g. a replaced meter) and the new value is accepted
+const maxEnergyRejects = 60
+
+var (
+	// last plausible energy counter published per path, in kWh
+	lastEnergy    = map[string]float64{}
+	energyRejects = map[string]int{}
+)
+
+// updateEnergy publishes an energy counter unless it is implausible. VRM keeps lifetime
+// totals from these, so a single misdecoded value would poison them forever.
+func updateEnergy(value float64, path string) {
+	if offset, ok := cfg.EnergyOffsets[path]; ok {
+		// Counted before e.g. a replaced inverter, the user doesn't want it in VRM
+		value -= offset
+		if value < 0 {
+			value = 0
+		}
+	}
+	if !energyPlausible(path, value) {
+		return
+	}
+	if cfg.EnergyDelta {
+		updateDelta(path, value)
+	}
+	updateVariant(value, "kWh", path)
+}
+
+// deltaPath is where the delta of the energy counter on path is published, e.g.
+// /Debug/Ac/L1/Energy/ForwardDelta for /Ac/L1/Energy/Forward
+func deltaPath(path string) string {
+	return "/Debug" + path + "Delta"
+}
+
+// updateDelta publishes the Wh the counter on path grew by since the previous update.
+// The first update has nothing to compare with and a counter accepted as reset would give
+// a negative delta, both are skipped.
+func updateDelta(path string, value float64) {
+	last, seen := deltaBase[path]
+	deltaBase[path] = value
+	if !seen || value < last {
+		return
+	}
+	updateVariant((value-last)*1000, "Wh", deltaPath(path))
+}
+
+// markDeltaInterval publishes the time since the previous update with energy counters,
+// the period the deltas were counted over
+func markDeltaInterval(now time.Time) {
+	if !lastDeltaAt.IsZero() {
+		updateVariant(now.Sub(lastDeltaAt).Seconds(), "s", deltaIntervalPath)
+	}
+	lastDeltaAt = now
+}
+
+// phaseEnergySupplied tells whether the per-phase energy counters should be published.
+// Some SHM variants always send 0 for them, which would show up in VRM as phases without
+// any lifetime energy. If the first few updates carry none, the per-phase energy paths
+// are removed from dbus and only the totals are published.
+func phaseEnergySupplied(phases []singlePhase) bool {
+	if phaseEnergyKnown {
+		return phaseEnergyPresent
+	}
+
+	for _, L := range phases {
+		if L.forward != 0 || L.reverse != 0 {
+			phaseEnergyKnown, phaseEnergyPresent = true, true
+			return true
+		}
+	}
+
+	phaseEnergyZeros++
+	if phaseEnergyZeros < phaseEnergyProbe {
+		return false
+	}
+
+	log.Info("The meter doesn't send per-phase energy counters, only publishing the totals")
+	phaseEnergyKnown, phaseEnergyPresent = true, false
+	for i := range phases {
+		for _, dir := range []string{"Forward", "Reverse"} {
+			path := "/Ac/" + phaseNames[i] + "/Energy/" + dir
+			unexport(path)
+			if cfg.EnergyDelta {
+				unexport(deltaPath(path))
+			}
+		}
+	}
+	return false
+}
+
+// unexport removes path from the values and from dbus, where the nodes above it stop
+// listing it
+func unexport(path string) {
+	valuesMu.Lock()
+	delete(victronValues[0], objectpath(path))
+	delete(victronValues[1], objectpath(path))
+	valuesMu.Unlock()
+
+	treeMu.Lock()
+	defer treeMu.Unlock()
+	kept := treePaths[:0]
+	for _, p := range treePaths {
+		if p != dbus.ObjectPath(path) {
+			kept = append(kept, p)
+		}
+	}
+	treePaths = kept
+	if c := busConn(); c != nil {
+		c.Export(nil, dbus.ObjectPath(path), "com.victronenergy.BusItem")
+		c.Export(nil, dbus.ObjectPath(path), "org.freedesktop.DBus.Introspectable")
+		treeNodes = exportTree(c, treePaths, treeNodes)
+	}
+}
+
+// energyPlausible checks a decoded counter against the last good one: it must be below
+// ENERGY_MAX, must not go backwards and must not grow by more than ENERGY_MAX_STEP.
+func energyPlausible(path string, value float64) bool {
+	last, seen := lastEnergy[path]
+
+	reason := ""
+	switch {
+	case value < 0 || value > cfg.EnergyMax:
+		reason = "is out of range"
+	case seen && value < last:
+		reason = "went backwards"
+	case seen && value-last > cfg.EnergyMaxStep:
+		reason = "jumped too far"
+	}
+
+	if reason == "" {
+		lastEnergy[path] = value
+		energyRejects[path] = 0
+		return true
+	}
+
+	energyRejects[path]++
+	if seen && energyRejects[path] >= maxEnergyRejects && value <= cfg.EnergyMax && value >= 0 {
+		log.Warnf("Energy counter %s stayed at %.2f kWh instead of %.2f kWh, accepting it as reset", path, value, last)
+		lastEnergy[path] = value
+		energyRejects[path] = 0
+		return true
+	}
+
+	log.Warnf("Energy counter %s %s (%.2f kWh, last good %.2f kWh), not publishing it", path, reason, value, last)
+	count(&stats.rejected)
+	return false
+}
+
+// loadEnergyState puts the energy counters saved by the last run in place of the 0 kWh
+// defaults, so nothing jumps to 0 until the first datagram arrives after a restart
+func loadEnergyState(path string) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Warn("Could not read energy state: ", err)
+		return
+	}
+
+	var state map[string]float64
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Warn("Could not parse energy state in ", path, ": ", err)
+		return
+	}
+
+	for p, v := range state {
+		if _, ok := victronValues[0][objectpath(p)]; !ok {
+			continue
+		}
+		victronValues[0][objectpath(p)] = dbus.MakeVariant(v)
+		victronValues[1][objectpath(p)] = dbus.MakeVariant(formatValue(v, "kWh"))
+		delete(placeholders, objectpath(p))
+		lastEnergy[p] = v
+	}
+	takeSnapshot()
+	log.Info("Restored ", len(state), " energy counters from ", path)
+}
+
+// saveEnergyState writes the currently published energy counters to path
+func saveEnergyState(path string) error {
+	state := map[string]float64{}
+	valuesMu.RLock()
+	for p, v := range victronValues[0] {
+		if !strings.HasSuffix(string(p), "/Energy/Forward") && !strings.HasSuffix(string(p), "/Energy/Reverse") {
+			continue
+		}
+		if placeholders[p] {
+			// Never received, e.g. from a source without energy counters
+			continue
+		}
+		if f, ok := v.Value().(float64); ok {
+			state[string(p)] = f
+		}
+	}
+	valuesMu.RUnlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write a new file and swap it in, so a power cut doesn't leave half a file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistEnergy saves the energy counters every interval. Not every second, as the
+// GX devices keep /data on flash.
+func persistEnergy(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := saveEnergyState(path); err != nil {
+			log.Warn("Could not save energy state: ", err)
+		}
+	}
+}
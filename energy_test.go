@@ -0,0 +1,58 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import "testing"
+
+func TestEnergyPlausible(t *testing.T) {
+	resetState(t)
+	const path = "/Ac/Energy/Forward"
+	steps := []struct {
+		value float64
+		ok    bool
+	}{
+		{1000, true},
+		{1000.5, true},
+		{1721346537, false}, // a misdecoded counter, above ENERGY_MAX
+		{-1, false},
+		{999, false},   // rolled over or backwards
+		{1100, false},  // more than ENERGY_MAX_STEP at once
+		{1005.5, true}, // the last good one is still 1000.5
+	}
+	for _, s := range steps {
+		if ok := energyPlausible(path, s.value); ok != s.ok {
+			t.Errorf("%v kWh accepted: %v, want %v", s.value, ok, s.ok)
+		}
+	}
+	if lastEnergy[path] != 1005.5 {
+		t.Errorf("last good %v kWh, want 1005.5", lastEnergy[path])
+	}
+
+	// A replaced meter starts at 0 again, after maxEnergyRejects updates in a row that is
+	// accepted. An implausible value never is.
+	for i := 1; i <= maxEnergyRejects; i++ {
+		if ok := energyPlausible(path, 5); ok != (i == maxEnergyRejects) {
+			t.Fatalf("reset to 5 kWh accepted after %d updates: %v", i, ok)
+		}
+	}
+	if lastEnergy[path] != 5 {
+		t.Errorf("last good %v kWh after the reset, want 5", lastEnergy[path])
+	}
+	for i := 0; i < 2*maxEnergyRejects; i++ {
+		if energyPlausible(path, 1721346537) {
+			t.Fatalf("%v kWh accepted after %d updates", 1721346537.0, i+1)
+		}
+	}
+}
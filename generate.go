@@ -0,0 +1,152 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"math"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The SUSy ID generated updates claim to come from, an Energy Meter 2.0
+const generateSusyID = 349
+
+// generate sends made-up meter updates to the multicast group, so a setup can be tried
+// without a meter. The values are taken from the flags after "generate".
+func generate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	power := fs.Float64("power", 1500, "total power in W, negative when selling")
+	voltage := fs.Float64("voltage", 230, "voltage of every phase in V")
+	forward := fs.Float64("forward", 1000, "energy bought in kWh")
+	reverse := fs.Float64("reverse", 500, "energy sold in kWh")
+	frequency := fs.Float64("frequency", 50, "frequency in Hz")
+	serial := fs.Uint("serial", 1900000000, "serial number of the made-up meter")
+	count := fs.Int("count", 0, "number of updates to send, 0 keeps going")
+	interval := fs.Duration("interval", time.Second, "time between updates")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.MulticastAddress)
+	if err != nil {
+		return err
+	}
+	c, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := setMulticastOptions(c, addr.IP.To4() == nil); err != nil {
+		log.Warn("Could not set MULTICAST_LOOP or MULTICAST_TTL: ", err)
+	}
+
+	log.Infof("Sending updates of meter %d to %s: %.1f W, %.1f V", *serial, addr, *power, *voltage)
+	start := time.Now()
+	for i := 0; *count == 0 || i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+			// Let the energy grow with the power, so the plausibility checks are happy
+			kWh := *power * interval.Hours() / 1000
+			if kWh > 0 {
+				*forward += kWh
+			} else {
+				*reverse -= kWh
+			}
+		}
+
+		phase := map[quantity]float64{
+			qPower:         *power / float64(cfg.Phases),
+			qApparentPower: *power / float64(cfg.Phases),
+			qCurrent:       math.Abs(*power / float64(cfg.Phases) / *voltage),
+			qVoltage:       *voltage,
+			qEnergyForward: *forward / float64(cfg.Phases),
+			qEnergyReverse: *reverse / float64(cfg.Phases),
+		}
+		totals := map[quantity]float64{
+			qPower:         *power,
+			qApparentPower: *power,
+			qEnergyForward: *forward,
+			qEnergyReverse: *reverse,
+			qFrequency:     *frequency,
+		}
+		ticker := uint32(time.Since(start) / time.Millisecond)
+		if _, err := c.Write(encodeUpdate(uint32(*serial), ticker, totals, phase)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeUpdate builds a meter update in the speedwire layout, the inverse of msgHandler.
+// The same values are sent for every phase in use.
+func encodeUpdate(serial, ticker uint32, totals, phase map[quantity]float64) []byte {
+	model := speedwire
+	b := make([]byte, model.versionOffset+8+4)
+
+	copy(b[0:4], "SMA\x00")
+	binary.BigEndian.PutUint16(b[4:6], 4)
+	binary.BigEndian.PutUint16(b[6:8], 0x02a0)
+	binary.BigEndian.PutUint32(b[8:12], 1)
+	// Length of everything from the protocol ID to the end marker
+	binary.BigEndian.PutUint16(b[12:14], uint16(len(b)-4-16))
+	binary.BigEndian.PutUint16(b[14:16], 0x0010)
+	binary.BigEndian.PutUint16(b[16:18], 0x6069)
+	binary.BigEndian.PutUint16(b[18:20], generateSusyID)
+	binary.BigEndian.PutUint32(b[20:24], serial)
+	binary.BigEndian.PutUint32(b[24:28], ticker)
+
+	encodeFields(b, model.totals, totals, 0)
+	for i := 0; i < cfg.Phases; i++ {
+		encodeFields(b[model.phaseOffset+i*model.phaseLen:], model.phase, phase, 20*i)
+	}
+
+	// Software version 2.0.0.R
+	binary.BigEndian.PutUint32(b[model.versionOffset:], 0x90000000)
+	copy(b[model.versionOffset+4:], []byte{2, 0, 0, 'R'})
+	return b
+}
+
+// encodeFields writes values into b as decodeFields reads them, each with its OBIS code
+// in front. Positive values go to the buying half of a pair, negative ones to the selling
+// half. obisShift is added to the OBIS channel, 20 per phase after L1.
+func encodeFields(b []byte, fields []obisField, values map[quantity]float64, obisShift int) {
+	for _, f := range fields {
+		v := values[f.quantity]
+		if f.sell {
+			v = -v
+		}
+		if v < 0 {
+			v = 0
+		}
+		// The scale functions are linear, one unit of the meter is scale(1, 0)
+		raw := uint64(math.Round(v / f.scale(1, 0)))
+
+		b[f.offset-4] = 0
+		b[f.offset-3] = byte(f.channel() + obisShift)
+		b[f.offset-2] = byte(f.size)
+		b[f.offset-1] = 0
+
+		if f.size == 8 {
+			binary.BigEndian.PutUint64(b[f.offset:], raw)
+		} else {
+			binary.BigEndian.PutUint32(b[f.offset:], uint32(raw))
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	t.Setenv("MULTICAST_ADDR", l.LocalAddr().String())
+	resetState(t)
+
+	// Returns once the updates asked for are sent
+	if err := generate([]string{"-count", "2", "-interval", "1ms", "-power", "-1200", "-serial", "1900000042"}); err != nil {
+		t.Fatal(err)
+	}
+	setupValues(roles[cfg.Role])
+	b := make([]byte, maxDatagramSize)
+	for i := 0; i < 2; i++ {
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := l.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decodeUpdate(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !near(float64(r.power), -1200) {
+			t.Errorf("update %d has %v W, want -1200", i, r.power)
+		}
+	}
+
+	if err := generate([]string{"-nonsense"}); err == nil {
+		t.Error("no error for an unknown flag")
+	}
+}
@@ -1,10 +1,22 @@
 module shm-et340
 
-go 1.16
+go 1.19
 
 require (
-	github.com/dmichael/go-multicast v0.0.0-20191021152323-097bfd85720a
-	github.com/godbus/dbus v4.1.0+incompatible
+	github.com/BurntSushi/toml v1.4.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/godbus/dbus/v5 v5.0.3
 	github.com/sirupsen/logrus v1.8.0
+	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/magefile/mage v1.10.0 // indirect
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/sync v0.6.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
 )
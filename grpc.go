@@ -0,0 +1,164 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"shm-et340/meterpb"
+)
+
+// The fields of MeterReading and Phase in meterpb/meter.proto by dbus path, the per-phase
+// ones below /Ac/Lx/
+var (
+	grpcTotals = []struct {
+		path  string
+		field protoreflect.Name
+	}{
+		{"/Ac/Power", "power"},
+		{"/Ac/Current", "current"},
+		{"/Ac/Voltage", "voltage"},
+		{"/Ac/Frequency", "frequency"},
+		{"/Ac/ReactivePower", "reactive_power"},
+		{"/Ac/ApparentPower", "apparent_power"},
+		{"/Ac/PowerFactor", "power_factor"},
+		{"/Ac/Energy/Forward", "energy_forward"},
+		{"/Ac/Energy/Reverse", "energy_reverse"},
+	}
+	grpcPhase = []struct {
+		path  string
+		field protoreflect.Name
+	}{
+		{"Power", "power"},
+		{"Current", "current"},
+		{"Voltage", "voltage"},
+		{"ReactivePower", "reactive_power"},
+		{"ApparentPower", "apparent_power"},
+		{"PowerFactor", "power_factor"},
+		{"Energy/Forward", "energy_forward"},
+		{"Energy/Reverse", "energy_reverse"},
+	}
+)
+
+// grpcSubscribers wake up the streams after a meter update. Like with MQTT, a slow client
+// skips the updates in between instead of holding up msgHandler.
+var (
+	grpcMu          sync.Mutex
+	grpcSubscribers = map[chan struct{}]bool{}
+)
+
+// notifyGRPC tells every stream there are new values, without ever blocking
+func notifyGRPC() {
+	grpcMu.Lock()
+	defer grpcMu.Unlock()
+	for ch := range grpcSubscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// serveGRPC streams the meter updates to gRPC clients on addr, without TLS. It only
+// returns if the listener fails.
+func serveGRPC(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error("Could not serve gRPC: ", err)
+		return
+	}
+	srv := grpc.NewServer()
+	meterpb.RegisterMeterServer(srv, meterServer{})
+	log.Info("Serving gRPC on ", addr)
+	log.Error("gRPC server stopped: ", srv.Serve(l))
+}
+
+// meterServer is the Meter service of meterpb
+type meterServer struct {
+	meterpb.UnimplementedMeterServer
+}
+
+// Subscribe sends the current values, then again after every meter update until the
+// client goes away
+func (meterServer) Subscribe(_ *meterpb.SubscribeRequest, stream meterpb.Meter_SubscribeServer) error {
+	updates := make(chan struct{}, 1)
+	grpcMu.Lock()
+	grpcSubscribers[updates] = true
+	grpcMu.Unlock()
+	defer func() {
+		grpcMu.Lock()
+		delete(grpcSubscribers, updates)
+		grpcMu.Unlock()
+	}()
+	log.Debug("gRPC client subscribed")
+
+	for {
+		if err := stream.Send(grpcReading()); err != nil {
+			log.Debug("gRPC client gone: ", err)
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			log.Debug("gRPC client unsubscribed")
+			return nil
+		case <-updates:
+		}
+	}
+}
+
+// grpcReading is a MeterReading of the current values. Paths without a value, e.g. still
+// holding their placeholder, leave their field unset.
+func grpcReading() *meterpb.MeterReading {
+	values := snapshotValues()
+	valuesMu.RLock()
+	serial, at := meterSerial, lastPacket
+	valuesMu.RUnlock()
+
+	r := &meterpb.MeterReading{Serial: serial}
+	if !at.IsZero() {
+		ms := at.UnixNano() / 1e6
+		r.TimestampMs = &ms
+	}
+	for _, t := range grpcTotals {
+		if v, ok := values[t.path]; ok {
+			setDouble(r.ProtoReflect(), t.field, v)
+		}
+	}
+	for _, phase := range phaseNames[:cfg.Phases] {
+		if _, ok := values["/Ac/"+phase+"/Power"]; !ok {
+			// PUBLISH_PHASES=false, or nothing received yet
+			break
+		}
+		p := &meterpb.Phase{Name: phase}
+		for _, f := range grpcPhase {
+			if v, ok := values["/Ac/"+phase+"/"+f.path]; ok {
+				setDouble(p.ProtoReflect(), f.field, v)
+			}
+		}
+		r.Phases = append(r.Phases, p)
+	}
+	return r
+}
+
+// setDouble sets the double field of m with the given name
+func setDouble(m protoreflect.Message, field protoreflect.Name, v float64) {
+	m.Set(m.Descriptor().Fields().ByName(field), protoreflect.ValueOfFloat64(v))
+}
@@ -0,0 +1,88 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"shm-et340/meterpb"
+)
+
+func TestGRPCSubscribe(t *testing.T) {
+	resetState(t)
+	setupValues(roles[cfg.Role])
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	meterpb.RegisterMeterServer(srv, meterServer{})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	client, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := meterpb.NewMeterClient(client).Subscribe(ctx, &meterpb.SubscribeRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Before the first update everything is a placeholder, which must not show up as 0 W
+	r, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Power != nil || r.Voltage != nil || r.EnergyForward != nil || r.TimestampMs != nil || len(r.Phases) > 0 {
+		t.Errorf("placeholders sent before the first update: %v", r)
+	}
+
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b), b)
+	r, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Serial != 1901234567 {
+		t.Errorf("serial %d, want 1901234567", r.Serial)
+	}
+	if r.TimestampMs == nil {
+		t.Error("no timestamp")
+	}
+	if r.Power == nil || !near(*r.Power, 2345.6) {
+		t.Errorf("power %v, want 2345.6", r.Power)
+	}
+	if r.EnergyForward == nil || !near(*r.EnergyForward, 1234.5) {
+		t.Errorf("energy forward %v, want 1234.5", r.EnergyForward)
+	}
+	if len(r.Phases) != 3 {
+		t.Fatalf("%d phases, want 3", len(r.Phases))
+	}
+	if L2 := r.Phases[1]; L2.Name != "L2" || L2.Power == nil || !near(*L2.Power, -250) {
+		t.Errorf("phase %s power %v, want L2 -250", L2.Name, L2.Power)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDatagramSize is well above the largest meter update seen, about 600 bytes from a
+// Sunny Home Manager 2.0, so none gets cut off by the receive buffer
+const maxDatagramSize = 8192
+
+// multicastInterface looks up the interface the multicast group should be joined on.
+// An empty name leaves the choice to the kernel, as long as there is any to choose from.
+func multicastInterface(name string) (*net.Interface, error) {
+	if name == "" {
+		if !anyMulticastInterface() {
+			hint := ""
+			if inContainer() {
+				hint = ". In a container, run it with the host's network (docker run --network host)"
+			}
+			return nil, fmt.Errorf("no network interface is up and supports multicast, the meter's updates can't arrive%s", hint)
+		}
+		return nil, nil
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("network interface %q not found: %v", name, err)
+	}
+	if ifi.Flags&net.FlagMulticast == 0 {
+		return nil, fmt.Errorf("network interface %q does not support multicast", name)
+	}
+	return ifi, nil
+}
+
+// anyMulticastInterface tells whether any interface besides loopback could receive the
+// meter's multicast
+func anyMulticastInterface() bool {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		// Can't tell, let joining the group decide
+		return true
+	}
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// inContainer tells whether we run in a Docker or Podman container, to give hints about
+// what the container needs
+func inContainer() bool {
+	for _, path := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// listen joins the multicast group at address (IPv4 or IPv6) on ifi (nil for the system default) and
+// hands every datagram received to handler. When nothing arrives for REJOIN_TIMEOUT,
+// e.g. because the interface went down or got a new address, the group is left and
+// joined again. It returns nil once ctx is done, otherwise only on errors. The handler
+// must not keep a reference to the buffer it is given.
+func listen(ctx context.Context, address string, ifi *net.Interface, handler func(*net.UDPAddr, int, []byte)) error {
+	addr, err := multicastGroup(address)
+	if err != nil {
+		return err
+	}
+
+	sock, err := join(addr, ifi)
+	if err != nil {
+		return err
+	}
+
+	// Closing the socket is the only way to interrupt a blocked read. The socket is
+	// replaced when joining again, so it's only touched with sockMu held.
+	var sockMu sync.Mutex
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sockMu.Lock()
+			sock.Close()
+			sockMu.Unlock()
+		case <-done:
+		}
+	}()
+
+	if ifi != nil {
+		log.Info("Listening for meter updates on ", address, " via ", ifi.Name)
+	} else {
+		log.Info("Listening for meter updates on ", address)
+	}
+
+	// The handler is done with a datagram before the next one is read, so the same
+	// buffer can be used for all of them instead of allocating one every second
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		if cfg.RejoinTimeout > 0 {
+			sock.SetReadDeadline(time.Now().Add(cfg.RejoinTimeout))
+		}
+		n, src, err := sock.ReadFromUDP(buffer)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				sock.Close()
+				return fmt.Errorf("ReadFromUDP failed: %v", err)
+			}
+
+			sock.Close()
+			for {
+				log.Warn("No meter update for ", cfg.RejoinTimeout, ", joining ", address, " again")
+				newSock, err := join(addr, ifi)
+				if err == nil {
+					sockMu.Lock()
+					sock = newSock
+					sockMu.Unlock()
+					if ctx.Err() != nil {
+						sock.Close()
+						return nil
+					}
+					break
+				}
+				log.Warn("Could not join the multicast group: ", err)
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(cfg.RejoinTimeout):
+				}
+			}
+			continue
+		}
+
+		handler(src, n, buffer)
+	}
+}
+
+// multicastGroup parses the group and port in address, e.g. 239.12.255.254:9522 or
+// [ff12::9522]:9522, where an IPv6 group may carry the interface as its zone
+func multicastGroup(address string) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", address)
+	}
+	return addr, nil
+}
+
+// groupNetwork is the network to listen on for the multicast group addr
+func groupNetwork(addr *net.UDPAddr) string {
+	if addr.IP.To4() == nil {
+		return "udp6"
+	}
+	return "udp4"
+}
+
+// join opens a socket on the multicast group addr, which may be IPv4 or IPv6
+func join(addr *net.UDPAddr, ifi *net.Interface) (*net.UDPConn, error) {
+	sock, err := net.ListenMulticastUDP(groupNetwork(addr), ifi, addr)
+	if err != nil {
+		return nil, err
+	}
+	sock.SetReadBuffer(maxDatagramSize)
+	return sock, nil
+}
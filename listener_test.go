@@ -0,0 +1,106 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// returnsOnCancel runs run, cancels its context after started and fails unless run then
+// returns nil in time
+func returnsOnCancel(t *testing.T, started <-chan struct{}, run func(ctx context.Context) error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- run(ctx) }()
+
+	select {
+	case <-started:
+	case err := <-done:
+		t.Fatal("returned before being cancelled: ", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("never started")
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("returned ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still running after the context was cancelled")
+	}
+}
+
+func TestListenCancel(t *testing.T) {
+	resetState(t)
+	addr, err := net.ResolveUDPAddr("udp", cfg.MulticastAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock, err := join(addr, nil)
+	if err != nil {
+		t.Skip("can't join the multicast group here: ", err)
+	}
+	sock.Close()
+
+	// Nothing is sent, listen is blocked reading when cancelled
+	started := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(started)
+	}()
+	returnsOnCancel(t, started, func(ctx context.Context) error {
+		return listen(ctx, cfg.MulticastAddress, nil, msgHandler)
+	})
+}
+
+func TestMulticastGroup(t *testing.T) {
+	tests := []struct {
+		address string
+		network string // "" if it must be rejected
+		zone    string
+	}{
+		{"239.12.255.254:9522", "udp4", ""},
+		{"[ff12::9522]:9522", "udp6", ""},
+		{"[ff02::1%eth0]:9522", "udp6", "eth0"},
+		{"192.168.1.10:9522", "", ""}, // not a multicast address
+		{"[fe80::1]:9522", "", ""},
+		{"239.12.255.254", "", ""}, // no port
+	}
+	for _, tt := range tests {
+		addr, err := multicastGroup(tt.address)
+		if tt.network == "" {
+			if err == nil {
+				t.Errorf("%s accepted as %v", tt.address, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.address, err)
+			continue
+		}
+		if got := groupNetwork(addr); got != tt.network {
+			t.Errorf("%s: network %s, want %s", tt.address, got, tt.network)
+		}
+		if addr.Port != 9522 || addr.Zone != tt.zone {
+			t.Errorf("%s: port %d zone %q, want 9522 and %q", tt.address, addr.Port, addr.Zone, tt.zone)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// setLogFormat applies LOG_TIME_FORMAT: rfc3339 or rfc3339nano for full timestamps, none
+// to leave them to multilog, or a Go time layout like 15:04:05.000. Unset keeps logrus'
+// default, full timestamps only when not writing to a terminal.
+func setLogFormat() {
+	layout := os.Getenv("LOG_TIME_FORMAT")
+	switch strings.ToLower(layout) {
+	case "":
+		return
+	case "none":
+		log.SetFormatter(&log.TextFormatter{DisableTimestamp: true})
+		return
+	case "rfc3339":
+		layout = time.RFC3339
+	case "rfc3339nano":
+		layout = time.RFC3339Nano
+	}
+	log.SetFormatter(&log.TextFormatter{FullTimestamp: true, TimestampFormat: layout})
+}
+
+// logFile is the file setLogOutput sends the log to, nil while logging to stdout
+var logFile *rotatingFile
+
+// setLogOutput sends the log to LOG_FILE instead of stdout, starting a new file once it
+// reaches LOG_FILE_SIZE MB and keeping LOG_FILE_KEEP old ones as LOG_FILE.1, .2, ...
+// Calling it again after the settings changed closes the file logged to before.
+func setLogOutput() {
+	path := os.Getenv("LOG_FILE")
+	size := envInt("LOG_FILE_SIZE", 10)
+	if size < 1 {
+		size = 10
+	}
+	keep := envInt("LOG_FILE_KEEP", 3)
+	if keep < 0 {
+		keep = 3
+	}
+
+	previous := logFile
+	if previous != nil && previous.path == path && previous.max == int64(size)<<20 && previous.keep == keep {
+		return
+	}
+	if path == "" {
+		if previous != nil {
+			log.SetOutput(os.Stderr)
+			logFile = nil
+			previous.close()
+		}
+		return
+	}
+
+	f := &rotatingFile{path: path, max: int64(size) << 20, keep: keep}
+	if err := f.open(); err != nil {
+		log.Warn("Could not open LOG_FILE, logging to stdout: ", err)
+		return
+	}
+	log.SetOutput(f)
+	logFile = f
+	if previous != nil {
+		previous.close()
+	}
+}
+
+// rotatingFile is an io.Writer appending to path, rotating it when it grows beyond max
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	max  int64
+	keep int
+	f    *os.File
+	size int64
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.max {
+		if err := r.rotate(); err != nil {
+			// Keep writing to the old file rather than losing the log
+			fmt.Fprintln(os.Stderr, "Could not rotate the log file:", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// rotate moves the current file to .1, .1 to .2 and so on, dropping the oldest
+func (r *rotatingFile) rotate() error {
+	if r.keep == 0 {
+		if err := r.f.Truncate(0); err != nil {
+			return err
+		}
+		r.size = 0
+		return nil
+	}
+
+	r.f.Close()
+	for i := r.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		r.open()
+		return err
+	}
+	return r.open()
+}
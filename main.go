@@ -16,31 +16,64 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
 	"net"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/dmichael/go-multicast/multicast"
-	"github.com/godbus/dbus/introspect"
 	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	address = "239.12.255.254:9522"
+	// headerLen covers the SMA tag, protocol ID, SUSyID and serial, which are all
+	// checked before the datagram is identified as a meter update
+	headerLen = 24
+	// Each phase has a block of phaseLen bytes, the first starting at phaseOffset.
+	// This is the layout of all known meters, see models for the ones using it.
+	phaseOffset = 164
+	phaseLen    = 144
 )
 
-var conn, err = dbus.SystemBus()
+// conn stays nil with NO_DBUS and while reconnecting, everything publishing on dbus has
+// to cope with that. Use busConn() outside of bus.go.
+var conn *dbus.Conn
+
+// packetLimit stops the program after that many decoded meter updates (-packets, -once),
+// through stopRun which ends the listener like SIGTERM does. 0 runs forever.
+var (
+	packetLimit uint64
+	stopRun     context.CancelFunc
+)
+
+// serviceName is the name claimed on dbus by registerDBus
+var serviceName string
+
+// version is stamped in at build time with -ldflags "-X main.version=$(git describe --tags)"
+var version = "dev"
 
 type singlePhase struct {
-	voltage float32 // Volts: 230,0
-	a       float32 // Amps: 8,3
-	power   float32 // Watts: 1909
-	forward float64 // kWh, purchased power
-	reverse float64 // kWh, sold power
+	voltage  float32 // Volts: 230,0
+	a        float32 // Amps: 8,3
+	power    float32 // Watts: 1909
+	reactive float32 // var: -120,4
+	apparent float32 // VA: 1930
+	pf       float32 // power factor, signed like power: 0,99
+	forward  float64 // kWh, purchased power
+	reverse  float64 // kWh, sold power
 }
 
 const intro = `
@@ -61,8 +94,151 @@ const intro = `
     </method>
 	</interface>` + introspect.IntrospectDataString + `</node> `
 
+// meterRole describes how the meter is announced for one of the uses Venus supports.
+// DEVICE_TYPE and PRODUCT_ID override the role's /DeviceType and /ProductId.
+type meterRole struct {
+	service    string // dbus service name prefix
+	position   bool   // whether /Position (which AC input/output) is exported
+	deviceType int    // /DeviceType
+	productID  uint16 // /ProductId
+	sold       bool   // whether the counters of energy sold are exported
+}
+
+// The ET340 as connected through dbus-cgwacs, the device type is that of the hardware
+const (
+	et340DeviceType = 71
+	et340ProductID  = 0xb002
+)
+
+var roles = map[string]meterRole{
+	"grid": {service: "com.victronenergy.grid", deviceType: et340DeviceType, productID: et340ProductID, sold: true},
+	// The product id dbus-fronius gives SunSpec PV inverters, so the GUI and VRM list
+	// the meter among the PV inverters rather than as an energy meter
+	"pvinverter": {service: "com.victronenergy.pvinverter", position: true, deviceType: et340DeviceType, productID: 0xa144, sold: true},
+	"genset":     {service: "com.victronenergy.genset", deviceType: et340DeviceType, productID: et340ProductID, sold: true},
+	// A load only ever consumes, what Venus reads of it is the power and energy bought
+	"acload": {service: "com.victronenergy.acload", deviceType: et340DeviceType, productID: et340ProductID},
+}
+
+// has tells whether path is exported for the role. Without sold, every counter of energy
+// sold is left out, the meter's and the ones derived from the power.
+func (r meterRole) has(path string) bool {
+	return r.sold || !strings.Contains(path, "Reverse")
+}
+
+// phaseNames are the phases in the order the meter sends them
+var phaseNames = []string{"L1", "L2", "L3"}
+
+// phaseDefaults are the paths below /Ac/Lx published for every phase, with their
+// values until the first meter update arrives
+var phaseDefaults = []struct {
+	path  string
+	value interface{}
+	text  string
+}{
+	{"Power", 0.0, "0 W"},
+	{"Voltage", 230.0, "230 V"},
+	{"Current", 0.0, "0 A"},
+	{"Energy/Forward", 0.0, "0 kWh"},
+	{"Energy/Reverse", 0.0, "0 kWh"},
+	{"ReactivePower", 0.0, "0 var"},
+	{"ApparentPower", 0.0, "0 VA"},
+	{"PowerFactor", 0.0, "0"},
+}
+
+const rootIntro = `
+<node>
+   <interface name="com.victronenergy.BusItem">
+    <signal name="ItemsChanged">
+      <arg type="a{sa{sv}}" name="items" />
+    </signal>
+    <method name="GetItems">
+      <arg direction="out" type="a{sa{sv}}" />
+    </method>
+    <method name="GetText">
+      <arg direction="out" type="v" />
+    </method>
+    <method name="GetValue">
+      <arg direction="out" type="v" />
+    </method>
+	</interface>` + introspect.IntrospectDataString + `</node> `
+
+// nodeIntro is the introspection data of the nodes between "/" and the paths, which only
+// have nodes below them
+const nodeIntro = `<node>` + introspect.IntrospectDataString + `</node>`
+
+// childNodes returns the names of the nodes directly below every node leading to paths,
+// e.g. "Ac" and "Serial" for "/" with /Ac/Power and /Serial
+func childNodes(paths []dbus.ObjectPath) map[dbus.ObjectPath][]string {
+	seen := map[dbus.ObjectPath]bool{}
+	tree := map[dbus.ObjectPath][]string{}
+	for _, p := range paths {
+		for node := p; node != "/"; {
+			i := strings.LastIndex(string(node), "/")
+			parent := dbus.ObjectPath(node[:i])
+			if parent == "" {
+				parent = "/"
+			}
+			if !seen[node] {
+				seen[node] = true
+				tree[parent] = append(tree[parent], string(node[i+1:]))
+			}
+			node = parent
+		}
+	}
+	for _, children := range tree {
+		sort.Strings(children)
+	}
+	return tree
+}
+
+var (
+	// treeMu guards treePaths, the paths exported on dbus, and treeNodes, the nodes
+	// exported on the way to them
+	treeMu    sync.Mutex
+	treePaths []dbus.ObjectPath
+	treeNodes map[dbus.ObjectPath]bool
+)
+
+// exportTree exports the introspection of "/" and of every node on the way to paths,
+// e.g. /Ac and /Ac/L1, as scanners which walk the tree by introspection start at "/" and
+// need each node to list the ones below it. Nodes in old which no longer lead to any path
+// are dropped. It returns the nodes exported, to pass as old next time.
+func exportTree(conn *dbus.Conn, paths []dbus.ObjectPath, old map[dbus.ObjectPath]bool) map[dbus.ObjectPath]bool {
+	tree := childNodes(paths)
+	nodes := make(map[dbus.ObjectPath]bool, len(tree))
+	for node, children := range tree {
+		if node == "/" {
+			conn.Export(withChildren(rootIntro, children), node, "org.freedesktop.DBus.Introspectable")
+			continue
+		}
+		conn.Export(withChildren(nodeIntro, children), node, "org.freedesktop.DBus.Introspectable")
+		nodes[node] = true
+	}
+	for node := range old {
+		if !nodes[node] {
+			conn.Export(nil, node, "org.freedesktop.DBus.Introspectable")
+		}
+	}
+	return nodes
+}
+
+// withChildren adds a <node> for each child to the introspection data xml
+func withChildren(xml string, children []string) introspect.Introspectable {
+	var nodes strings.Builder
+	for _, c := range children {
+		fmt.Fprintf(&nodes, `<node name="%s"/>`, c)
+	}
+	end := strings.LastIndex(xml, "</node>")
+	return introspect.Introspectable(xml[:end] + nodes.String() + xml[end:])
+}
+
 type objectpath string
 
+// rootObject answers the calls on "/", which scanners like dbus-mqtt use to fetch the
+// whole service at once instead of asking every path
+type rootObject struct{}
+
 var victronValues = map[int]map[objectpath]dbus.Variant{
 	// 0: This will be used to store the VALUE variant
 	0: map[objectpath]dbus.Variant{},
@@ -70,53 +246,311 @@ var victronValues = map[int]map[objectpath]dbus.Variant{
 	1: map[objectpath]dbus.Variant{},
 }
 
+var (
+	// valuesMu guards victronValues and the bookkeeping below, which are read by dbus
+	// method calls and background timers while the multicast listener is updating them
+	valuesMu     sync.RWMutex
+	pendingItems = map[string]map[string]dbus.Variant{}
+	lastEmit     time.Time
+	lastPacket   time.Time
+	packetCount  uint64
+	meterSerial  uint32
+	meterSusyID  uint16
+	// meterID is the serial as published on /Serial, the only one for meters with a
+	// serial of text like the EM24
+	meterID string
+	// placeholders are the paths still holding their default from before the first meter
+	// update, which must not show up as e.g. a reading of 230 V
+	placeholders = map[objectpath]bool{}
+	connected    = true
+)
+
 func (f objectpath) GetValue() (dbus.Variant, *dbus.Error) {
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
 	log.Debug("GetValue() called for ", f)
-	log.Debug("...returning ", victronValues[0][f])
-	return victronValues[0][f], nil
+	value, _ := published(f)
+	log.Debug("...returning ", value)
+	return value, nil
 }
 func (f objectpath) GetText() (string, *dbus.Error) {
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
 	log.Debug("GetText() called for ", f)
-	log.Debug("...returning ", victronValues[1][f])
+	_, text := published(f)
+	log.Debug("...returning ", text)
 	// Why does this end up ""SOMEVAL"" ... trim it I guess
-	return strings.Trim(victronValues[1][f].String(), "\""), nil
+	return strings.Trim(text.String(), "\""), nil
+}
+
+// published is what dbus gets to see of path. As long as it only holds a placeholder,
+// that is an empty array, which Venus takes as invalid, like the Victron services
+// publish values they don't know yet. valuesMu must be held.
+func published(path objectpath) (value, text dbus.Variant) {
+	if placeholders[path] {
+		return dbus.MakeVariant([]int32{}), dbus.MakeVariant("")
+	}
+	return victronValues[0][path], victronValues[1][path]
+}
+
+// snapshotItem is the value and text of one path, as copied by snapshotItems
+type snapshotItem struct {
+	value interface{}
+	text  string
+}
+
+var (
+	snapshotMu sync.RWMutex
+	// snapshot is the copy of the values taken by takeSnapshot
+	snapshot map[string]snapshotItem
+)
+
+// takeSnapshot copies the value and text of every path, for snapshotItems to hand out.
+// publishReading updates the paths one at a time, so it only takes the copy once all of
+// them hold the new meter update. Paths still holding their default from before the
+// first update are left out, as dbus publishes them as invalid too.
+func takeSnapshot() {
+	valuesMu.RLock()
+	items := make(map[string]snapshotItem, len(victronValues[0]))
+	for p, v := range victronValues[0] {
+		if placeholders[p] {
+			continue
+		}
+		items[string(p)] = snapshotItem{v.Value(), strings.Trim(victronValues[1][p].String(), "\"")}
+	}
+	valuesMu.RUnlock()
+
+	snapshotMu.Lock()
+	snapshot = items
+	snapshotMu.Unlock()
+}
+
+// snapshotItems returns the values as of the last takeSnapshot, so the HTTP, MQTT and
+// gRPC outputs can format them without holding valuesMu meanwhile. All of them are from
+// the same meter update. The map is shared, it must not be changed.
+func snapshotItems() map[string]snapshotItem {
+	snapshotMu.RLock()
+	defer snapshotMu.RUnlock()
+	return snapshot
+}
+
+// snapshotValues is snapshotItems reduced to the paths holding a number
+func snapshotValues() map[string]float64 {
+	items := snapshotItems()
+	values := make(map[string]float64, len(items))
+	for p, it := range items {
+		if f, ok := it.value.(float64); ok {
+			values[p] = f
+		}
+	}
+	return values
+}
+
+// GetValue on the root returns all values keyed by their path relative to "/", like the
+// Victron python services do
+func (rootObject) GetValue() (dbus.Variant, *dbus.Error) {
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
+	log.Debug("GetValue() called for /")
+	values := make(map[string]dbus.Variant, len(victronValues[0]))
+	for p := range victronValues[0] {
+		values[strings.TrimPrefix(string(p), "/")], _ = published(p)
+	}
+	return dbus.MakeVariant(values), nil
+}
+
+// GetText on the root returns all texts keyed by their path relative to "/"
+func (rootObject) GetText() (dbus.Variant, *dbus.Error) {
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
+	log.Debug("GetText() called for /")
+	texts := make(map[string]string, len(victronValues[1]))
+	for p := range victronValues[1] {
+		_, text := published(p)
+		texts[strings.TrimPrefix(string(p), "/")] = strings.Trim(text.String(), "\"")
+	}
+	return dbus.MakeVariant(texts), nil
+}
+
+// GetItems returns every path with its value and text, in the same form as ItemsChanged
+func (rootObject) GetItems() (map[string]map[string]dbus.Variant, *dbus.Error) {
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
+	log.Debug("GetItems() called for /")
+	items := make(map[string]map[string]dbus.Variant, len(victronValues[0]))
+	for p := range victronValues[0] {
+		value, text := published(p)
+		items[string(p)] = map[string]dbus.Variant{
+			"Value": value,
+			"Text":  dbus.MakeVariant(strings.Trim(text.String(), "\"")),
+		}
+	}
+	return items, nil
 }
 
 func init() {
-	lvl, ok := os.LookupEnv("LOG_LEVEL")
-	if !ok {
-		lvl = "info"
+	loadConfigFile()
+	setLogLevel()
+	setLogFormat()
+	setLogOutput()
+	cfg = loadConfig()
+}
+
+func main() {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Uint64Var(&packetLimit, "packets", 0, "stop after this many meter updates, e.g. for scripts")
+	once := flag.Bool("once", false, "stop after the first meter update, same as -packets 1")
+	configFile := flag.String("config", "", "read the settings from this TOML file, the same as CONFIG_FILE")
+	flag.Parse()
+	if *configFile != "" {
+		// The settings were read before the flags were, read them again with the file
+		os.Setenv("CONFIG_FILE", *configFile)
+		loadConfigFile()
+		setLogLevel()
+		setLogFormat()
+		setLogOutput()
+		cfg = loadConfig()
+	}
+	if *once {
+		packetLimit = 1
 	}
+	if *showVersion {
+		fmt.Println("shm-et340", version)
+		return
+	}
+	if flag.Arg(0) == "decode" {
+		if err := decodeOnce(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "generate" {
+		if err := generate(flag.Args()[1:]); err != nil {
+			if err == flag.ErrHelp {
+				return
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+	log.Info("shm-et340 version ", version)
 
-	ll, err := log.ParseLevel(lvl)
+	if len(cfg.Meters) > 0 {
+		runMeters(cfg.Meters)
+		return
+	}
+	log.Infof("Announcing as device type %d, product id 0x%04x", cfg.DeviceType, cfg.ProductID)
+	role := roles[cfg.Role]
+	basicPaths, updatingPaths := setupValues(role)
+
+	if cfg.StateFile != "" {
+		loadEnergyState(cfg.StateFile)
+	}
+
+	if cfg.NoDBus {
+		log.Info("NO_DBUS is set, only logging the decoded values")
+	} else {
+		if err := connectDBus(role, basicPaths, updatingPaths); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Successfully connected to dbus and registered as a meter... Commencing reading of the SMA meter")
+		go watchBus(role, basicPaths, updatingPaths)
+	}
+	sdNotify("READY=1")
+
+	go handleSignals()
+	if cfg.HeartbeatInterval > 0 {
+		go heartbeat(cfg.HeartbeatInterval)
+	}
+	if cfg.PublishInterval > 0 {
+		go publishLoop(cfg.PublishInterval)
+	}
+	if cfg.StaleTimeout > 0 {
+		go staleWatchdog(cfg.StaleTimeout)
+	}
+	if cfg.StateFile != "" {
+		go persistEnergy(cfg.StateFile, cfg.StateInterval)
+	}
+	if cfg.StatsInterval > 0 {
+		go logStats(cfg.StatsInterval)
+	}
+	if cfg.MQTTBroker != "" {
+		go runMQTT()
+	}
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(cfg.MetricsAddr)
+	}
+	if cfg.StatusAddr != "" {
+		go serveStatus(cfg.StatusAddr)
+	}
+	if cfg.GRPCAddr != "" {
+		go serveGRPC(cfg.GRPCAddr)
+	}
+
+	// SIGINT and SIGTERM stop the listener, so the state can be saved and the dbus name
+	// released before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, stopRun = context.WithCancel(ctx)
+
+	if cfg.ReplayFile != "" {
+		if err := replay(ctx, cfg.ReplayFile, cfg.ReplayTiming, msgHandler); err != nil {
+			log.Fatal("Replay failed: ", err)
+		}
+		shutdown()
+		return
+	}
+
+	if cfg.Source == "modbus" {
+		if err := runModbus(ctx); err != nil {
+			log.Fatal(err)
+		}
+		shutdown()
+		return
+	}
+
+	handler := msgHandler
+	if cfg.CaptureFile != "" {
+		handler = capture(cfg.CaptureFile, handler)
+	}
+
+	ifi, err := multicastInterface(cfg.Interface)
 	if err != nil {
-		ll = log.DebugLevel
+		log.Fatal(err)
 	}
 
-	log.SetLevel(ll)
+	// This is a forever loop, unless the socket breaks or we're told to stop
+	if err := listen(ctx, cfg.MulticastAddress, ifi, handler); err != nil {
+		log.Fatal(err)
+	}
+	shutdown()
 }
 
-func main() {
+// setupValues fills victronValues with the defaults of every path of role, and returns
+// the paths to export: the basic ones, which describe the meter, and the updating ones,
+// which every meter update changes
+func setupValues(role meterRole) (basicPaths, updatingPaths []dbus.ObjectPath) {
 	// Need to implement following paths:
 	// https://github.com/victronenergy/venus/wiki/dbus#grid-meter
 	// also in system.py
 	victronValues[0]["/Connected"] = dbus.MakeVariant(1)
 	victronValues[1]["/Connected"] = dbus.MakeVariant("1")
 
-	victronValues[0]["/CustomName"] = dbus.MakeVariant("Grid meter")
-	victronValues[1]["/CustomName"] = dbus.MakeVariant("Grid meter")
+	victronValues[0]["/CustomName"] = dbus.MakeVariant(cfg.CustomName)
+	victronValues[1]["/CustomName"] = dbus.MakeVariant(cfg.CustomName)
 
-	victronValues[0]["/DeviceInstance"] = dbus.MakeVariant(30)
-	victronValues[1]["/DeviceInstance"] = dbus.MakeVariant("30")
+	victronValues[0]["/DeviceInstance"] = dbus.MakeVariant(cfg.DeviceInstance)
+	victronValues[1]["/DeviceInstance"] = dbus.MakeVariant(strconv.Itoa(cfg.DeviceInstance))
 
 	// also in system.py
-	victronValues[0]["/DeviceType"] = dbus.MakeVariant(71)
-	victronValues[1]["/DeviceType"] = dbus.MakeVariant("71")
+	victronValues[0]["/DeviceType"] = dbus.MakeVariant(cfg.DeviceType)
+	victronValues[1]["/DeviceType"] = dbus.MakeVariant(strconv.Itoa(cfg.DeviceType))
 
 	victronValues[0]["/ErrorCode"] = dbus.MakeVariantWithSignature(0, dbus.SignatureOf(123))
 	victronValues[1]["/ErrorCode"] = dbus.MakeVariant("0")
 
-	victronValues[0]["/FirmwareVersion"] = dbus.MakeVariant(2)
+	// A text from the start, the version in the meter updates replaces it
+	victronValues[0]["/FirmwareVersion"] = dbus.MakeVariant("2")
 	victronValues[1]["/FirmwareVersion"] = dbus.MakeVariant("2")
 
 	// also in system.py
@@ -126,20 +560,18 @@ func main() {
 	victronValues[0]["/Mgmt/ProcessName"] = dbus.MakeVariant("/opt/color-control/dbus-cgwacs/dbus-cgwacs")
 	victronValues[1]["/Mgmt/ProcessName"] = dbus.MakeVariant("/opt/color-control/dbus-cgwacs/dbus-cgwacs")
 
-	victronValues[0]["/Mgmt/ProcessVersion"] = dbus.MakeVariant("1.8.0")
-	victronValues[1]["/Mgmt/ProcessVersion"] = dbus.MakeVariant("1.8.0")
-
-	victronValues[0]["/Position"] = dbus.MakeVariantWithSignature(0, dbus.SignatureOf(123))
-	victronValues[1]["/Position"] = dbus.MakeVariant("0")
+	victronValues[0]["/Mgmt/ProcessVersion"] = dbus.MakeVariant(version)
+	victronValues[1]["/Mgmt/ProcessVersion"] = dbus.MakeVariant(version)
 
 	// also in system.py
-	victronValues[0]["/ProductId"] = dbus.MakeVariant(45058)
-	victronValues[1]["/ProductId"] = dbus.MakeVariant("45058")
+	victronValues[0]["/ProductId"] = dbus.MakeVariant(int(cfg.ProductID))
+	victronValues[1]["/ProductId"] = dbus.MakeVariant(strconv.Itoa(int(cfg.ProductID)))
 
 	// also in system.py
-	victronValues[0]["/ProductName"] = dbus.MakeVariant("Grid meter")
-	victronValues[1]["/ProductName"] = dbus.MakeVariant("Grid meter")
+	victronValues[0]["/ProductName"] = dbus.MakeVariant(cfg.ProductName)
+	victronValues[1]["/ProductName"] = dbus.MakeVariant(cfg.ProductName)
 
+	// Replaced by the meter's serial once its first update arrives
 	victronValues[0]["/Serial"] = dbus.MakeVariant("BP98305081235")
 	victronValues[1]["/Serial"] = dbus.MakeVariant("BP98305081235")
 
@@ -152,42 +584,50 @@ func main() {
 	//@400000005ecc11bf387b28ec     return sum(values) if values else None
 	//@400000005ecc11bf38b2bb7c TypeError: unsupported operand type(s) for +: 'int' and 'unicode'
 	//
-	victronValues[0]["/Ac/L1/Power"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L1/Power"] = dbus.MakeVariant("0 W")
-	victronValues[0]["/Ac/L2/Power"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L2/Power"] = dbus.MakeVariant("0 W")
-	victronValues[0]["/Ac/L3/Power"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L3/Power"] = dbus.MakeVariant("0 W")
-
-	victronValues[0]["/Ac/L1/Voltage"] = dbus.MakeVariant(230)
-	victronValues[1]["/Ac/L1/Voltage"] = dbus.MakeVariant("230 V")
-	victronValues[0]["/Ac/L2/Voltage"] = dbus.MakeVariant(230)
-	victronValues[1]["/Ac/L2/Voltage"] = dbus.MakeVariant("230 V")
-	victronValues[0]["/Ac/L3/Voltage"] = dbus.MakeVariant(230)
-	victronValues[1]["/Ac/L3/Voltage"] = dbus.MakeVariant("230 V")
-
-	victronValues[0]["/Ac/L1/Current"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L1/Current"] = dbus.MakeVariant("0 A")
-	victronValues[0]["/Ac/L2/Current"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L2/Current"] = dbus.MakeVariant("0 A")
-	victronValues[0]["/Ac/L3/Current"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L3/Current"] = dbus.MakeVariant("0 A")
-
-	victronValues[0]["/Ac/L1/Energy/Forward"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L1/Energy/Forward"] = dbus.MakeVariant("0 kWh")
-	victronValues[0]["/Ac/L2/Energy/Forward"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L2/Energy/Forward"] = dbus.MakeVariant("0 kWh")
-	victronValues[0]["/Ac/L3/Energy/Forward"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L3/Energy/Forward"] = dbus.MakeVariant("0 kWh")
-
-	victronValues[0]["/Ac/L1/Energy/Reverse"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L1/Energy/Reverse"] = dbus.MakeVariant("0 kWh")
-	victronValues[0]["/Ac/L2/Energy/Reverse"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L2/Energy/Reverse"] = dbus.MakeVariant("0 kWh")
-	victronValues[0]["/Ac/L3/Energy/Reverse"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L3/Energy/Reverse"] = dbus.MakeVariant("0 kWh")
-
-	basicPaths := []dbus.ObjectPath{
+	victronValues[0]["/Ac/Power"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Ac/Power"] = dbus.MakeVariant("0 W")
+	victronValues[0]["/Ac/Energy/Forward"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Ac/Energy/Forward"] = dbus.MakeVariant("0 kWh")
+	victronValues[0]["/Ac/Energy/Reverse"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Ac/Energy/Reverse"] = dbus.MakeVariant("0 kWh")
+
+	victronValues[0]["/Ac/ReactivePower"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Ac/ReactivePower"] = dbus.MakeVariant("0 var")
+	victronValues[0]["/Ac/ApparentPower"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Ac/ApparentPower"] = dbus.MakeVariant("0 VA")
+
+	victronValues[0]["/Ac/PowerFactor"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Ac/PowerFactor"] = dbus.MakeVariant("0")
+
+	victronValues[0]["/Ac/Frequency"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Ac/Frequency"] = dbus.MakeVariant("0 Hz")
+
+	victronValues[0]["/Ac/Voltage"] = dbus.MakeVariant(230.0)
+	victronValues[1]["/Ac/Voltage"] = dbus.MakeVariant("230 V")
+	victronValues[0]["/Ac/Current"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Ac/Current"] = dbus.MakeVariant("0 A")
+
+	// The GUI only draws this many phases
+	victronValues[0]["/Ac/NumberOfPhases"] = dbus.MakeVariant(cfg.Phases)
+	victronValues[1]["/Ac/NumberOfPhases"] = dbus.MakeVariant(strconv.Itoa(cfg.Phases))
+
+	victronValues[0][sessionForwardPath] = dbus.MakeVariant(0.0)
+	victronValues[1][sessionForwardPath] = dbus.MakeVariant("0 kWh")
+	victronValues[0][sessionReversePath] = dbus.MakeVariant(0.0)
+	victronValues[1][sessionReversePath] = dbus.MakeVariant("0 kWh")
+	// Written to reset the two above, always reads 0
+	victronValues[0][sessionResetPath] = dbus.MakeVariantWithSignature(0, dbus.SignatureOf(123))
+	victronValues[1][sessionResetPath] = dbus.MakeVariant("0")
+
+	victronValues[0][integratedForwardPath] = dbus.MakeVariant(0.0)
+	victronValues[1][integratedForwardPath] = dbus.MakeVariant("0 kWh")
+	victronValues[0][integratedReversePath] = dbus.MakeVariant(0.0)
+	victronValues[1][integratedReversePath] = dbus.MakeVariant("0 kWh")
+
+	victronValues[0]["/Uptime"] = dbus.MakeVariant(0.0)
+	victronValues[1]["/Uptime"] = dbus.MakeVariant("0 s")
+
+	basicPaths = []dbus.ObjectPath{
 		"/Connected",
 		"/CustomName",
 		"/DeviceInstance",
@@ -197,188 +637,1092 @@ func main() {
 		"/Mgmt/Connection",
 		"/Mgmt/ProcessName",
 		"/Mgmt/ProcessVersion",
-		"/Position",
 		"/ProductId",
 		"/ProductName",
 		"/Serial",
+		"/Ac/NumberOfPhases",
 	}
 
-	updatingPaths := []dbus.ObjectPath{
-		"/Ac/L1/Power",
-		"/Ac/L2/Power",
-		"/Ac/L3/Power",
-		"/Ac/L1/Voltage",
-		"/Ac/L2/Voltage",
-		"/Ac/L3/Voltage",
-		"/Ac/L1/Current",
-		"/Ac/L2/Current",
-		"/Ac/L3/Current",
-		"/Ac/L1/Energy/Forward",
-		"/Ac/L2/Energy/Forward",
-		"/Ac/L3/Energy/Forward",
-		"/Ac/L1/Energy/Reverse",
-		"/Ac/L2/Energy/Reverse",
-		"/Ac/L3/Energy/Reverse",
+	// Only for the roles which export it, GetItems on "/" must not list it otherwise
+	if role.position {
+		victronValues[0]["/Position"] = dbus.MakeVariantWithSignature(cfg.Position, dbus.SignatureOf(123))
+		victronValues[1]["/Position"] = dbus.MakeVariant(strconv.Itoa(cfg.Position))
+		basicPaths = append(basicPaths, "/Position")
+	}
+	if cfg.MaxPower > 0 {
+		victronValues[0]["/Ac/MaxPower"] = dbus.MakeVariant(float64(cfg.MaxPower))
+		victronValues[1]["/Ac/MaxPower"] = dbus.MakeVariant(fmt.Sprintf("%d W", cfg.MaxPower))
+		basicPaths = append(basicPaths, "/Ac/MaxPower")
 	}
 
-	defer conn.Close()
+	updatingPaths = []dbus.ObjectPath{
+		"/Ac/Power",
+		"/Ac/ReactivePower",
+		"/Ac/ApparentPower",
+		"/Ac/PowerFactor",
+		"/Ac/Frequency",
+		"/Ac/Voltage",
+		"/Ac/Current",
+		"/Uptime",
+		sessionForwardPath,
+		sessionReversePath,
+		sessionResetPath,
+		integratedForwardPath,
+		integratedReversePath,
+	}
+	if cfg.EnergyCounters {
+		updatingPaths = append(updatingPaths, "/Ac/Energy/Forward", "/Ac/Energy/Reverse")
+		if cfg.EnergyRaw {
+			for _, path := range []string{rawForwardPath, rawReversePath} {
+				victronValues[0][objectpath(path)] = dbus.MakeVariant(0.0)
+				victronValues[1][objectpath(path)] = dbus.MakeVariant("0 Ws")
+				updatingPaths = append(updatingPaths, dbus.ObjectPath(path))
+			}
+		}
+		if cfg.EnergyDelta {
+			victronValues[0][deltaIntervalPath] = dbus.MakeVariant(0.0)
+			victronValues[1][deltaIntervalPath] = dbus.MakeVariant("0 s")
+			updatingPaths = append(updatingPaths, deltaIntervalPath)
+			for _, path := range []string{"/Ac/Energy/Forward", "/Ac/Energy/Reverse"} {
+				victronValues[0][objectpath(deltaPath(path))] = dbus.MakeVariant(0.0)
+				victronValues[1][objectpath(deltaPath(path))] = dbus.MakeVariant("0 Wh")
+				updatingPaths = append(updatingPaths, dbus.ObjectPath(deltaPath(path)))
+			}
+		}
+	} else {
+		delete(victronValues[0], "/Ac/Energy/Forward")
+		delete(victronValues[1], "/Ac/Energy/Forward")
+		delete(victronValues[0], "/Ac/Energy/Reverse")
+		delete(victronValues[1], "/Ac/Energy/Reverse")
+	}
 
-	// Some of the victron stuff requires it be called grid.cgwacs... using the only known valid value (from the simulator)
-	// This can _probably_ be changed as long as it matches com.victronenergy.grid.cgwacs_*
-	reply, err := conn.RequestName("com.victronenergy.grid.cgwacs_ttyUSB0_di30_mb1",
-		dbus.NameFlagDoNotQueue)
+	// Only the phases in use get their paths, a split-phase service has no L3
+	publishedPhases := phaseNames[:cfg.Phases]
+	if !cfg.PublishPhases {
+		publishedPhases = nil
+	}
+	for _, phase := range publishedPhases {
+		for _, d := range phaseDefaults {
+			if !cfg.EnergyCounters && strings.HasPrefix(d.path, "Energy/") {
+				continue
+			}
+			if d.path == "Energy/Reverse" && !phaseReverseCounted() {
+				continue
+			}
+			path := "/Ac/" + phase + "/" + d.path
+			victronValues[0][objectpath(path)] = dbus.MakeVariant(d.value)
+			victronValues[1][objectpath(path)] = dbus.MakeVariant(d.text)
+			updatingPaths = append(updatingPaths, dbus.ObjectPath(path))
+			if cfg.EnergyDelta && strings.HasPrefix(d.path, "Energy/") {
+				victronValues[0][objectpath(deltaPath(path))] = dbus.MakeVariant(0.0)
+				victronValues[1][objectpath(deltaPath(path))] = dbus.MakeVariant("0 Wh")
+				updatingPaths = append(updatingPaths, dbus.ObjectPath(deltaPath(path)))
+			}
+		}
+		for _, name := range []string{"PowerMin", "PowerMax"} {
+			path := watermarkPath(phase, name)
+			victronValues[0][objectpath(path)] = dbus.MakeVariant(0.0)
+			victronValues[1][objectpath(path)] = dbus.MakeVariant("0 W")
+			updatingPaths = append(updatingPaths, dbus.ObjectPath(path))
+		}
+	}
+
+	if cfg.Phases == 3 && cfg.PublishPhases {
+		for _, pair := range lineToLine {
+			path := lineVoltagePath(pair)
+			victronValues[0][objectpath(path)] = dbus.MakeVariant(0.0)
+			victronValues[1][objectpath(path)] = dbus.MakeVariant("0 V")
+			updatingPaths = append(updatingPaths, dbus.ObjectPath(path))
+		}
+	}
+
+	kept := updatingPaths[:0]
+	for _, p := range updatingPaths {
+		if role.has(string(p)) {
+			kept = append(kept, p)
+		} else {
+			delete(victronValues[0], objectpath(p))
+			delete(victronValues[1], objectpath(p))
+		}
+	}
+	updatingPaths = kept
+
+	// Until the first meter update, the defaults are published as invalid. The session
+	// reset is only ever written, its 0 is real.
+	for _, p := range updatingPaths {
+		if p != sessionResetPath {
+			placeholders[objectpath(p)] = true
+		}
+	}
+	takeSnapshot()
+	return basicPaths, updatingPaths
+}
+
+// shutdown saves what needs to survive a restart and leaves dbus
+func shutdown() {
+	log.Info("Shutting down")
+	if cfg.StateFile != "" {
+		if err := saveEnergyState(cfg.StateFile); err != nil {
+			log.Warn("Could not save the energy counters: ", err)
+		}
+	}
+	busMu.Lock()
+	c := conn
+	conn = nil
+	busMu.Unlock()
+	if c != nil {
+		if _, err := c.ReleaseName(serviceName); err != nil {
+			log.Warn("Could not release ", serviceName, ": ", err)
+		}
+		c.Close()
+	}
+}
+
+// isMeterUpdate checks the speedwire header: the "SMA" tag, the data tag (0x0010) and
+// the protocol ID of meter updates (0x6069). Discovery and inverter broadcasts on the same
+// port have other data tags or protocol IDs.
+func isMeterUpdate(b []byte) bool {
+	return string(b[0:4]) == "SMA\x00" &&
+		binary.BigEndian.Uint16(b[14:16]) == 0x0010 &&
+		binary.BigEndian.Uint16(b[16:18]) == 0x6069
+}
+
+// fewerPhasesLogged is set once the hint to lower PHASES was logged
+var fewerPhasesLogged bool
+
+// truncatedLogged is set once a datagram shorter than its header says was logged
+var truncatedLogged bool
+
+// The serial of the first meter update decoded, and whether updates from another meter
+// were logged since
+var (
+	firstSerial        uint32
+	mixedSerialsLogged bool
+)
+
+// checkSerial warns once when updates from more than one meter arrive without SERIAL
+// set. They would all be published as the same meter, jumping between their values.
+func checkSerial(serial uint32) {
+	if cfg.Serial > 0 || mixedSerialsLogged {
+		return
+	}
+	if firstSerial == 0 {
+		firstSerial = serial
+		return
+	}
+	if serial != firstSerial {
+		log.Warnf("Receiving updates from meters %d and %d, set SERIAL to the one to follow, or METERS for both", firstSerial, serial)
+		mixedSerialsLogged = true
+	}
+}
+
+// energyAbsentLogged is set once a meter without energy counters was logged
+var energyAbsentLogged bool
+
+// scannedLogged is set once an update which doesn't fit its model's layout was logged
+var scannedLogged bool
+
+// The reasons decodeUpdate rejects a datagram. They are wrapped with the details, compare
+// them with errors.Is.
+var (
+	errPacketTooShort = errors.New("too short")
+	errWrongMagic     = errors.New("not a meter update")
+	errSerialFiltered = errors.New("not from the meter followed")
+)
+
+func msgHandler(src *net.UDPAddr, n int, b []byte) {
+	// This function will be called with every datagram sent by the SMA meter
+	// 0-28: SMA/SUSyID/SN/Uptime
+	start := time.Now()
+	log.Debug("----------------------")
+	log.Debug("Received datagram from meter")
+	count(&stats.received)
+
+	if n > len(b) {
+		// More than the buffer holds can't have been received
+		n = len(b)
+	}
+	r, err := decodeUpdate(b[:n])
 	if err != nil {
-		log.Panic("Something went horribly wrong in the dbus connection")
-		panic(err)
+		log.Debug("Rejected datagram: ", err)
+		if errors.Is(err, errPacketTooShort) {
+			count(&stats.short)
+		} else {
+			count(&stats.filtered)
+		}
+		return
+	}
+
+	serial := binary.BigEndian.Uint32(b[20:24])
+	checkSerial(serial)
+	markPacket(serial, binary.BigEndian.Uint16(b[18:20]))
+	r.uptime = checkUptime(binary.BigEndian.Uint32(b[24:28]))
+
+	log.Debug("Uid: ", binary.BigEndian.Uint32(b[4:8]))
+	log.Debug("Serial: ", serial)
+
+	decodeLatency.observe(time.Since(start))
+	publishReading(r)
+}
+
+// decodeUpdate decodes one datagram into a reading, all but the uptime, which depends on
+// the updates before. A datagram which isn't an update from the meter followed is
+// rejected with one of the errors above.
+func decodeUpdate(b []byte) (meterReading, error) {
+	if len(b) < headerLen {
+		return meterReading{}, fmt.Errorf("%w to be from a meter, %d bytes", errPacketTooShort, len(b))
+	}
+
+	// There are some broadcast packets caught by the multicast listener, that the meter is sending to 9522.
+	// See https://github.com/mitchese/shm-et340/issues/2
+	if !isMeterUpdate(b) {
+		return meterReading{}, fmt.Errorf("%w, the speedwire header is % x", errWrongMagic, b[:18])
+	}
+
+	// A receive buffer too small for the datagram cuts it off without any error, but the
+	// header tells the length it was sent with, from the protocol ID to the end marker.
+	// Whatever still reaches the phases is decoded, the check below rejects the rest.
+	if sent := 16 + int(binary.BigEndian.Uint16(b[12:14])); len(b) < sent {
+		if !truncatedLogged {
+			log.Warnf("Received a meter update of %d bytes, but it was sent with %d, the receive buffer is too small", len(b), sent)
+			truncatedLogged = true
+		}
+		log.Debugf("Truncated datagram, %d of %d bytes", len(b), sent)
 	}
 
-	if reply != dbus.RequestNameReplyPrimaryOwner {
-		log.Panic("name cgwacs_ttyUSB0_di30_mb1 already taken on dbus.")
-		os.Exit(1)
+	serial := binary.BigEndian.Uint32(b[20:24])
+	susyID := binary.BigEndian.Uint16(b[18:20])
+	if serial == 0xffffffff {
+		return meterReading{}, fmt.Errorf("%w, implausible serial %d", errSerialFiltered, serial)
+	}
+	if cfg.Serial > 0 && cfg.Serial != serial {
+		return meterReading{}, fmt.Errorf("%w, only listening for updates from %d, but this one is from %d", errSerialFiltered, cfg.Serial, serial)
+	}
+	if cfg.SusyID > 0 && cfg.SusyID != susyID {
+		return meterReading{}, fmt.Errorf("%w, only listening for SUSy ID %d, but this update is from SUSy ID %d", errSerialFiltered, cfg.SusyID, susyID)
 	}
 
+	model := modelFor(susyID)
+	log.Debug("Model: ", model.name)
+	if !fitsLayout(b, model) {
+		if scanned, ok := scanLayout(b, model); ok {
+			if !scannedLogged {
+				log.Infof("The %s sends its values at other offsets than expected, finding them by their OBIS codes", model.name)
+				scannedLogged = true
+			}
+			model = scanned
+		}
+	}
+
+	// The last phase block is the furthest we read into a meter update
+	n := len(b)
+	if n < model.phaseOffset+cfg.Phases*model.phaseLen {
+		if fit := (n - model.phaseOffset) / model.phaseLen; fit > 0 && !fewerPhasesLogged {
+			// A single-phase meter's updates only have room for L1
+			log.Warnf("The meter only sends %d phase(s), set PHASES=%d to decode its updates", fit, fit)
+			fewerPhasesLogged = true
+		}
+		return meterReading{}, fmt.Errorf("%w to decode all phases from meter %d, %d bytes", errPacketTooShort, serial, n)
+	}
+
+	totalFields, phaseModel := model.totals, model
+	energy := cfg.EnergyCounters && sendsEnergy(b, model)
+	if !energy {
+		if cfg.EnergyCounters && !energyAbsentLogged {
+			log.Warn("The meter doesn't send energy counters, set ENERGY_COUNTERS=false to leave out their paths")
+			energyAbsentLogged = true
+		}
+		totalFields = withoutEnergy(model.totals)
+		phaseModel.phase = withoutEnergy(model.phase)
+	}
+
+	totals := decodeFields(b, totalFields)
+	r := meterReading{
+		energy:    energy,
+		power:     float32(totals.value[qPower]),
+		forward:   totals.value[qEnergyForward],
+		reverse:   totals.value[qEnergyReverse],
+		reactive:  float32(totals.value[qReactivePower]),
+		apparent:  float32(totals.value[qApparentPower]),
+		frequency: totals.value[qFrequency],
+		firmware:  softwareVersion(b, model),
+		phases:    make([]singlePhase, cfg.Phases),
+	}
+	if meterA, ok := totals.get(qCurrent); ok {
+		r.current = float32(meterA)
+	}
+	if energy {
+		r.rawEnergy = true
+		r.rawForward = rawValue(b, totalFields, qEnergyForward)
+		r.rawReverse = rawValue(b, totalFields, qEnergyReverse)
+	}
+	for i := range r.phases {
+		start := model.phaseOffset + i*model.phaseLen
+		r.phases[i] = decodePhaseChunk(b[start:start+model.phaseLen], phaseModel)
+	}
+	return r, nil
+}
+
+// meterReading is everything decoded from one meter update, whichever source it came from
+type meterReading struct {
+	power     float32 // W, positive when buying
+	energy    bool    // forward and reverse were sent
+	forward   float64 // kWh bought
+	reverse   float64 // kWh sold
+	reactive  float32 // var
+	apparent  float32 // VA
+	frequency float64 // Hz, 0 if the meter doesn't measure it
+	current   float32 // A, the meter's own total current, 0 if it doesn't send one
+	uptime    time.Duration
+	firmware  string // "" if unknown
+	phases    []singlePhase
+
+	// The energy counters as the meter sent them, only from speedwire
+	rawEnergy  bool
+	rawForward uint64 // Ws
+	rawReverse uint64 // Ws
+}
+
+// calibrate corrects the phases by POWER_SCALE_Lx, for CTs which read a few percent off.
+// The totals are corrected by the same amount, the energy counters are left as the
+// meter counted them.
+func (r *meterReading) calibrate() {
+	for i := range r.phases {
+		L := &r.phases[i]
+		scale := float32(cfg.PhaseScales[i])
+		if scale == 1 {
+			continue
+		}
+		r.power += L.power * (scale - 1)
+		r.reactive += L.reactive * (scale - 1)
+		r.apparent += L.apparent * (scale - 1)
+		if r.current != 0 {
+			// The meter's total is unsigned, the phase currents carry the sign of the power
+			r.current += float32(math.Abs(float64(L.a))) * (scale - 1)
+		}
+		L.power *= scale
+		L.reactive *= scale
+		L.apparent *= scale
+		L.a *= scale
+	}
+}
+
+// publishReading puts a meter update on dbus and everywhere else it goes
+func publishReading(r meterReading) {
+	start := time.Now()
+	r.calibrate()
+	log.Debug("Uptime: ", r.uptime)
+	log.Debug("Total W: ", r.power)
+	log.Debug("Total Buy kWh: ", r.forward)
+	log.Debug("Total Sell kWh: ", r.reverse)
+	log.Debug("Total var: ", r.reactive)
+	log.Debug("Total VA: ", r.apparent)
+	log.Debug("Frequency Hz: ", r.frequency)
+
+	// Every datagram received counts, so a gap between two updates is the datagrams left
+	// out as filtered or too short
+	seq := atomic.LoadUint64(&stats.received)
+	if r.energy {
+		log.Info(fmt.Sprintf("Meter update #%d received: %.2f kWh bought and %.2f kWh sold, %.1f W currently flowing", seq, r.forward, r.reverse, r.power))
+	} else {
+		log.Info(fmt.Sprintf("Meter update #%d received: %.1f W currently flowing", seq, r.power))
+	}
+	updateVariant(float64(r.power), "W", "/Ac/Power")
+	if r.energy && cfg.EnergyDelta {
+		markDeltaInterval(time.Now())
+	}
+	if r.energy {
+		updateEnergy(r.reverse, "/Ac/Energy/Reverse")
+		updateEnergy(r.forward, "/Ac/Energy/Forward")
+	}
+	if cfg.EnergyRaw && r.rawEnergy {
+		updateVariant(float64(r.rawForward), "Ws", rawForwardPath)
+		updateVariant(float64(r.rawReverse), "Ws", rawReversePath)
+	}
+	updateVariant(float64(r.reactive), "var", "/Ac/ReactivePower")
+	updateVariant(float64(r.apparent), "VA", "/Ac/ApparentPower")
+	updateVariant(float64(powerFactor(r.power, r.apparent)), "", "/Ac/PowerFactor")
+	if r.frequency > 0 {
+		updateVariant(r.frequency, "Hz", "/Ac/Frequency")
+	}
+	if r.uptime > 0 {
+		updateVariant(r.uptime.Seconds(), "s", "/Uptime")
+	}
+	if r.firmware != "" {
+		updateText("/FirmwareVersion", r.firmware)
+	}
+	integrateSession(r.power, meterClock(r.uptime))
+	if r.energy {
+		checkIntegrated(r.forward, r.reverse)
+	}
+
+	phases := r.phases
+	var voltagetot, currenttot float32
+	for _, L := range phases {
+		voltagetot += L.voltage
+		currenttot += L.a
+	}
+	// The average over the phases actually in use, a split-phase service only has two
+	voltagetot /= float32(len(phases))
+	if r.current != 0 && cfg.CurrentTotal == "meter" {
+		// The sum overstates the current of loads spread over the phases, the meter's own
+		// total accounts for the phase angles
+		currenttot = r.current
+	}
+
+	log.Debug("Average V: ", voltagetot)
+	log.Debug("Total A: ", currenttot)
+	updateVariant(float64(voltagetot), "V", "/Ac/Voltage")
+	updateVariant(float64(currenttot), "A", "/Ac/Current")
+
+	if cfg.NoDBus {
+		// Nothing goes anywhere else, so show everything
+		for _, line := range phaseTable(phases) {
+			log.Info(line)
+		}
+	} else if log.IsLevelEnabled(log.DebugLevel) {
+		for _, line := range phaseTable(phases) {
+			log.Debug(line)
+		}
+	}
+
+	// With PUBLISH_PHASES=false only the totals are published
+	if cfg.PublishPhases {
+		phaseEnergy := r.energy && phaseEnergySupplied(phases)
+		for i, L := range phases {
+			prefix := "/Ac/" + phaseNames[i] + "/"
+			updateVariant(float64(L.power), "W", prefix+"Power")
+			updateVariant(float64(L.voltage), "V", prefix+"Voltage")
+			updateVariant(float64(L.a), "A", prefix+"Current")
+			updateVariant(float64(L.reactive), "var", prefix+"ReactivePower")
+			updateVariant(float64(L.apparent), "VA", prefix+"ApparentPower")
+			updateVariant(float64(L.pf), "", prefix+"PowerFactor")
+			if phaseEnergy {
+				updateEnergy(L.forward, prefix+"Energy/Forward")
+				if phaseReverseCounted() {
+					updateEnergy(L.reverse, prefix+"Energy/Reverse")
+				}
+			}
+		}
+		if len(phases) == 3 {
+			for i, pair := range lineToLine {
+				updateVariant(lineVoltage(phases[i].voltage, phases[(i+1)%3].voltage), "V", lineVoltagePath(pair))
+			}
+		}
+		updateWatermarks(phases)
+	}
+	takeSnapshot()
+
+	flushItems()
+	notifyMQTT()
+	notifyGRPC()
+	count(&stats.decoded)
+	sdNotify("WATCHDOG=1")
+	publishLatency.observe(time.Since(start))
+
+	if packetLimit > 0 && stats.snapshot().decoded >= packetLimit && stopRun != nil {
+		log.Info("Decoded ", packetLimit, " meter updates, stopping as asked")
+		stopRun()
+	}
+}
+
+// lineToLine names the voltages between two phases, each from the phase of the same
+// index to the next one
+var lineToLine = []string{"L1L2", "L2L3", "L3L1"}
+
+// lineVoltagePath is where the voltage between a pair of phases is published, e.g.
+// /Ac/L1L2/Voltage. It is calculated from the phase voltages, see lineVoltage.
+func lineVoltagePath(pair string) string {
+	return "/Ac/" + pair + "/Voltage"
+}
+
+// lineVoltage is the voltage between two phases. The meter only measures each phase
+// against neutral, so this assumes the usual 120° between them.
+func lineVoltage(a, b float32) float64 {
+	return math.Sqrt(float64(a*a + b*b + a*b))
+}
+
+// lastTicker is the meter's millisecond counter from the last update, 0 before the first
+var lastTicker uint32
+
+// checkUptime turns the meter's millisecond counter into its uptime and logs when it
+// went backwards, i.e. the meter restarted. Energy counters jumping often go with that.
+func checkUptime(ticker uint32) time.Duration {
+	// The counter wraps after 49.7 days, which isn't a restart
+	const wrapMargin = 10 * 60 * 1000
+	if ticker < lastTicker && lastTicker < math.MaxUint32-wrapMargin {
+		log.Infof("The meter restarted, it was up for %s and is now up for %s",
+			time.Duration(lastTicker)*time.Millisecond, time.Duration(ticker)*time.Millisecond)
+	}
+	lastTicker = ticker
+	return time.Duration(ticker) * time.Millisecond
+}
+
+// softwareVersion decodes the meter's software version (OBIS 0:0.2.0), which follows the
+// L3 block, e.g. "2.3.4.R". It is "" for meters which don't send it.
+func softwareVersion(b []byte, model meterModel) string {
+	start := model.versionOffset
+	if len(b) < start+8 || binary.BigEndian.Uint32(b[start:start+4]) != 0x90000000 {
+		return ""
+	}
+	v := b[start+4 : start+8]
+	if v[3] >= 'A' && v[3] <= 'Z' {
+		return fmt.Sprintf("%d.%d.%d.%c", v[0], v[1], v[2], v[3])
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", v[0], v[1], v[2], v[3])
+}
+
+// Phase voltages outside this range mean the voltage is sent in other units than mV
+const (
+	minVoltage = 90
+	maxVoltage = 280
+)
+
+// voltageScales are the units meters were seen sending the voltage in, as the factor
+// from what mV decoding gives to volts. The first one is what the meters normally send.
+var voltageScales = []struct {
+	factor float32
+	unit   string
+}{
+	{1, "mV"},
+	{1000, "V"},
+	{100, "0.1 V"},
+	{10, "0.01 V"},
+}
+
+// voltageScale is the index into voltageScales detected for models which don't know
+// their unit, -1 until decided
+var voltageScale = -1
+
+// scaleVoltage converts a voltage decoded as mV into volts, in the unit the model
+// uses. If that isn't known, the unit giving a plausible value for the first voltage
+// other than 0 (SHM1.0 always sends 0) is picked.
+func scaleVoltage(v float32, model meterModel) float32 {
+	if model.voltageScale >= 0 {
+		return v * voltageScales[model.voltageScale].factor
+	}
+	if v == 0 {
+		return 0
+	}
+	if voltageScale < 0 {
+		for i, s := range voltageScales {
+			if scaled := v * s.factor; scaled >= minVoltage && scaled <= maxVoltage {
+				voltageScale = i
+				if i > 0 {
+					log.Infof("The meter sends voltages in %s, scaling them accordingly", s.unit)
+				}
+				break
+			}
+		}
+		if voltageScale < 0 {
+			log.Warnf("Voltage of %.2f V is implausible in any known unit, publishing it as is", v)
+			return v
+		}
+	}
+	return v * voltageScales[voltageScale].factor
+}
+
+// setCurrent sets the phase current from the magnitude the meter reports, or an
+// estimate from the apparent power (or, without that, the power) and voltage if it
+// reports none
+func (L *singlePhase) setCurrent(meterA float32) {
+	switch {
+	case meterA > 0:
+		// Victron expects the current to follow the power direction: positive
+		// when buying, negative when selling
+		L.a = meterA
+		if L.power < 0 {
+			L.a = -meterA
+		}
+	case L.voltage > 0 && L.apparent != 0:
+		// No current reported. The apparent power gives the RMS current, the power alone
+		// would come out too low for reactive loads.
+		L.a = float32(math.Abs(float64(L.apparent))) / L.voltage
+		if L.power < 0 {
+			L.a = -L.a
+		}
+	case L.voltage > 0:
+		// Nothing but the power, e.g. over Modbus
+		L.a = L.power / L.voltage
+	default:
+		// SHM1.0 sends 0 V, don't divide by zero
+		L.a = 0
+	}
+}
+
+func decodePhaseChunk(b []byte, model meterModel) singlePhase {
+	v := decodeFields(b, model.phase)
+	meterA := float32(v.value[qCurrent])
+
+	L := singlePhase{}
+	L.voltage = scaleVoltage(float32(v.value[qVoltage]), model)
+	L.power = float32(v.value[qPower])
+	L.reactive = float32(v.value[qReactivePower])
+	L.apparent = float32(v.value[qApparentPower])
+	L.pf = powerFactor(L.power, L.apparent)
+	L.setCurrent(meterA)
+	L.forward = v.value[qEnergyForward]
+	L.reverse = v.value[qEnergyReverse]
+
+	return L
+}
+
+// registerDBus exports all paths on conn and claims the service name for role. It runs
+// again after reconnecting, paths removed since the start are left out then.
+func registerDBus(conn *dbus.Conn, role meterRole, basicPaths, updatingPaths []dbus.ObjectPath) error {
+	// Some of the victron stuff requires it be called grid.cgwacs... using the only known valid value (from the simulator)
+	// This can _probably_ be changed as long as it matches com.victronenergy.grid.cgwacs_*
+	// Only on the first connection: after a reconnect our old instance is ours to keep,
+	// the service must not move to another one because of a name left on the bus
+	instanceOnce.Do(func() { checkDeviceInstance(conn, role) })
+
+	exported := make([]dbus.ObjectPath, 0, len(basicPaths)+len(updatingPaths))
 	for i, s := range basicPaths {
 		log.Debug("Registering dbus basic path #", i, ": ", s)
 		conn.Export(objectpath(s), s, "com.victronenergy.BusItem")
 		conn.Export(introspect.Introspectable(intro), s, "org.freedesktop.DBus.Introspectable")
+		exported = append(exported, s)
 	}
 
 	for i, s := range updatingPaths {
+		valuesMu.RLock()
+		_, ok := victronValues[0][objectpath(s)]
+		valuesMu.RUnlock()
+		if !ok {
+			continue
+		}
 		log.Debug("Registering dbus update path #", i, ": ", s)
 		conn.Export(objectpath(s), s, "com.victronenergy.BusItem")
 		conn.Export(introspect.Introspectable(intro), s, "org.freedesktop.DBus.Introspectable")
+		exported = append(exported, s)
 	}
 
-	log.Info("Successfully connected to dbus and registered as a meter... Commencing reading of the SMA meter")
+	conn.Export(rootObject{}, "/", "com.victronenergy.BusItem")
+	treeMu.Lock()
+	treePaths = exported
+	treeNodes = exportTree(conn, exported, nil)
+	treeMu.Unlock()
+
+	// Consumers start scanning as soon as the name shows up, so it is only claimed once
+	// every path is exported with its value
+	busName := serviceBusName(role, cfg.DeviceInstance)
+	if err := requestName(conn, busName, cfg.NameAttempts); err != nil {
+		return err
+	}
+	serviceName = busName
+	return nil
+}
 
-	multicast.Listen(address, msgHandler)
-	// This is a forever loop^^
-	panic("Error: We terminated.... how did we ever get here?")
+// handleSignals reloads the settings on SIGHUP. Only LOG_LEVEL and CUSTOM_NAME are
+// applied at runtime, everything else needs a restart.
+func handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Info("Received SIGHUP, reloading settings")
+		loadConfigFile()
+		setLogLevel()
+
+		// cfg is read everywhere without a lock, so the new name only goes to /CustomName
+		c := loadConfig()
+		valuesMu.Lock()
+		changed := victronValues[0]["/CustomName"].Value() != c.CustomName
+		if changed {
+			victronValues[0]["/CustomName"] = dbus.MakeVariant(c.CustomName)
+			victronValues[1]["/CustomName"] = dbus.MakeVariant(c.CustomName)
+		}
+		valuesMu.Unlock()
+		if changed {
+			log.Info("Changing custom name to ", c.CustomName)
+			takeSnapshot()
+			reemit("/CustomName")
+		}
+	}
 }
 
-func msgHandler(src *net.UDPAddr, n int, b []byte) {
-	// This function will be called with every datagram sent by the SMA meter
-	smasusyIDStr := os.Getenv("SMASUSYID")
-	smasusyID, err := strconv.ParseUint(smasusyIDStr, 10, 32)
-	if err != nil {
-		smasusyID = 0
+// customName is the name currently shown for the meter, CUSTOM_NAME unless SIGHUP changed it
+func customName() string {
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
+	name, _ := victronValues[0]["/CustomName"].Value().(string)
+	return name
+}
+
+// requestName claims name on the bus. When restarting, the old instance may not have
+// released it yet, so this waits with increasing pauses for up to attempts tries.
+func requestName(conn *dbus.Conn, name string, attempts int) error {
+	wait := time.Second
+	for i := 1; ; i++ {
+		reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
+		if err != nil {
+			return fmt.Errorf("something went horribly wrong in the dbus connection: %v", err)
+		}
+		if reply == dbus.RequestNameReplyPrimaryOwner {
+			return nil
+		}
+		if i >= attempts {
+			return fmt.Errorf("name %s already taken on dbus, gave up after %d attempts", name, attempts)
+		}
+
+		log.Warnf("Name %s already taken on dbus, retrying in %s (attempt %d of %d)", name, wait, i, attempts)
+		time.Sleep(wait)
+		if wait < 30*time.Second {
+			wait *= 2
+		}
 	}
+}
 
-	// 0-28: SMA/SUSyID/SN/Uptime
-	log.Debug("----------------------")
-	log.Debug("Received datagram from meter")
+// serviceBusName is the dbus name claimed for role with the given device instance
+func serviceBusName(role meterRole, instance int) string {
+	if cfg.DBusName != "" {
+		return cfg.DBusName
+	}
+	return fmt.Sprintf("%s.cgwacs_ttyUSB0_di%d_mb1", role.service, instance)
+}
 
-	// There are some broadcast packets caught by the multicast listener, that the meter is sending to 9522.
-	// See https://github.com/mitchese/shm-et340/issues/2
-	if 24681 != binary.BigEndian.Uint16(b[16:18]) {
-		log.Debug("The protocol ID didn't match 0x6069, it's not a meter update. ProtocolID: ", binary.BigEndian.Uint16(b[16:18]))
+// instanceOnce makes the device instance be chosen once at startup
+var instanceOnce sync.Once
+
+// checkDeviceInstance makes sure no other service of the same kind uses DEVICE_INSTANCE,
+// as two grid meters on 30 would both show up as one in VRM. With
+// DEVICE_INSTANCE_CONFLICT=next the next free instance is taken instead, otherwise it is
+// only logged.
+func checkDeviceInstance(conn *dbus.Conn, role meterRole) {
+	used := deviceInstances(conn, role.service)
+	// A name of our own is still held by the last run while restarting, that's no conflict
+	taken := func(instance int) bool {
+		owner, ok := used[instance]
+		return ok && owner != serviceBusName(role, instance)
+	}
+	if !taken(cfg.DeviceInstance) {
 		return
 	}
-
-	if binary.BigEndian.Uint32(b[20:24]) == 0xffffffff {
-		log.Debug("Implausible serial, rejecting")
+	owner := used[cfg.DeviceInstance]
+	if cfg.InstanceConflict != "next" {
+		log.Warnf("Device instance %d is already used by %s, set DEVICE_INSTANCE to a free one", cfg.DeviceInstance, owner)
 		return
 	}
 
-	if smasusyID > 0 && uint32(smasusyID) != binary.BigEndian.Uint32(b[20:24]) {
-		log.Debugf("Oops, I was told to only listen for updates from %d, but this update is from %d", smasusyID, binary.BigEndian.Uint32(b[20:24]))
+	for instance := cfg.DeviceInstance + 1; instance <= 255; instance++ {
+		if taken(instance) {
+			continue
+		}
+		log.Infof("Device instance %d is already used by %s, using %d instead", cfg.DeviceInstance, owner, instance)
+		cfg.DeviceInstance = instance
+		valuesMu.Lock()
+		victronValues[0]["/DeviceInstance"] = dbus.MakeVariant(instance)
+		victronValues[1]["/DeviceInstance"] = dbus.MakeVariant(strconv.Itoa(instance))
+		valuesMu.Unlock()
+		takeSnapshot()
 		return
 	}
+	log.Warnf("Device instance %d is already used by %s and none above it is free", cfg.DeviceInstance, owner)
+}
 
-	if n < 500 {
-		log.Debug("Received packet is probably too small. Size: ", n)
-		log.Debug("Serial: ", binary.BigEndian.Uint32(b[20:24]))
-		return
+// deviceInstances returns the device instances used by the other services of the same
+// kind (e.g. com.victronenergy.grid), with the name of the service using each
+func deviceInstances(conn *dbus.Conn, service string) map[int]string {
+	used := map[int]string{}
+	var names []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListNames", 0).Store(&names); err != nil {
+		log.Debug("Could not list dbus names: ", err)
+		return used
 	}
 
-	log.Debug("Uid: ", binary.BigEndian.Uint32(b[4:8]))
-	log.Debug("Serial: ", binary.BigEndian.Uint32(b[20:24]))
-
-	//              ...buy....                                 ...sell...  both in 0.1W, converted to W
-	powertot := ((float32(binary.BigEndian.Uint32(b[32:36])) - float32(binary.BigEndian.Uint32(b[52:56]))) / 10.0)
-
-	// in watt seconds, convert to kWh
-	bezugtot := float64(binary.BigEndian.Uint64(b[40:48])) / 3600.0 / 1000.0
-	einsptot := float64(binary.BigEndian.Uint64(b[60:68])) / 3600.0 / 1000.0
-
-	log.Debug("Total W: ", powertot)
-	log.Debug("Total Buy kWh: ", bezugtot)
-	log.Debug("Total Sell kWh: ", einsptot)
-
-	log.Info(fmt.Sprintf("Meter update received: %.2f kWh bought and %.2f kWh sold, %.1f W currently flowing", bezugtot, einsptot, powertot))
-	updateVariant(float64(powertot), "W", "/Ac/Power")
-	updateVariant(float64(einsptot), "kWh", "/Ac/Energy/Reverse")
-	updateVariant(float64(bezugtot), "kWh", "/Ac/Energy/Forward")
-
-	L1 := decodePhaseChunk(b[164:308])
-	L2 := decodePhaseChunk(b[308:452])
-	L3 := decodePhaseChunk(b[452:596])
-
-	log.Debug("+-----+-------------+---------------+---------------+")
-	log.Debug("|value|   L1 \t|     L2  \t|   L3  \t|")
-	log.Debug("+-----+-------------+---------------+---------------+")
-	log.Debug(fmt.Sprintf("|  V  | %8.2f \t| %8.2f \t| %8.2f \t|", L1.voltage, L2.voltage, L3.voltage))
-	log.Debug(fmt.Sprintf("|  A  | %8.2f \t| %8.2f \t| %8.2f \t|", L1.a, L2.a, L3.a))
-	log.Debug(fmt.Sprintf("|  W  | %8.2f \t| %8.2f \t| %8.2f \t|", L1.power, L2.power, L3.power))
-	log.Debug(fmt.Sprintf("| kWh | %8.2f \t| %8.2f \t| %8.2f \t|", L1.forward, L2.forward, L3.forward))
-	log.Debug(fmt.Sprintf("| kWh | %8.2f \t| %8.2f \t| %8.2f \t|", L1.reverse, L2.reverse, L3.reverse))
-	log.Debug("+-----+-------------+---------------+---------------+")
-
-	// L1
-	updateVariant(float64(L1.power), "W", "/Ac/L1/Power")
-	updateVariant(float64(L1.voltage), "V", "/Ac/L1/Voltage")
-	updateVariant(float64(L1.a), "A", "/Ac/L1/Current")
-	updateVariant(L1.forward, "kWh", "/Ac/L1/Energy/Forward")
-	updateVariant(L1.reverse, "kWh", "/Ac/L1/Energy/Reverse")
-
-	// L2
-	updateVariant(float64(L2.power), "W", "/Ac/L2/Power")
-	updateVariant(float64(L2.voltage), "V", "/Ac/L2/Voltage")
-	updateVariant(float64(L2.a), "A", "/Ac/L2/Current")
-	updateVariant(L2.forward, "kWh", "/Ac/L2/Energy/Forward")
-	updateVariant(L2.reverse, "kWh", "/Ac/L2/Energy/Reverse")
-
-	// L3
-	updateVariant(float64(L3.power), "W", "/Ac/L3/Power")
-	updateVariant(float64(L3.voltage), "V", "/Ac/L3/Voltage")
-	updateVariant(float64(L3.a), "A", "/Ac/L3/Current")
-	updateVariant(L3.forward, "kWh", "/Ac/L3/Energy/Forward")
-	updateVariant(L3.reverse, "kWh", "/Ac/L3/Energy/Reverse")
-
-}
-
-func decodePhaseChunk(b []byte) *singlePhase {
-
-	// why does this measure in 1/10 of watts?!
-	bezugW := float32(binary.BigEndian.Uint32(b[4:8])) / 10.0
-	einspeiseW := float32(binary.BigEndian.Uint32(b[24:28])) / 10.0
-
-	// this is in watt seconds ... chagne to kilo(100)watthour(3600)s:
-	bezugkWh := float64(binary.BigEndian.Uint64(b[12:20])) / 3600.0 / 1000.0
-	einspeisekWh := float64(binary.BigEndian.Uint64(b[32:40])) / 3600.0 / 1000.0
-
-	// not used, but leaving here for future
-	//bezugVA := float32(binary.BigEndian.Uint32(b[84:88])) / 10
-	//einspeiseVA := float32(binary.BigEndian.Uint32(b[104:108])) / 10
+	for _, name := range names {
+		if !strings.HasPrefix(name, service+".") {
+			continue
+		}
+		var v dbus.Variant
+		if err := conn.Object(name, "/DeviceInstance").Call("com.victronenergy.BusItem.GetValue", 0).Store(&v); err != nil {
+			log.Debug("Could not read /DeviceInstance of ", name, ": ", err)
+			continue
+		}
+		// Anything but a number, e.g. the empty array of an unknown value, is no instance
+		if instance, err := strconv.Atoi(fmt.Sprint(v.Value())); err == nil {
+			used[instance] = name
+		}
+	}
+	return used
+}
 
-	L := singlePhase{}
-	L.voltage = float32(binary.BigEndian.Uint32(b[132:136])) / 1000 // millivolts!
-	L.power = bezugW - einspeiseW
-	L.a = L.power / L.voltage
-	L.forward = bezugkWh
-	L.reverse = einspeisekWh
+// phaseTable formats the decoded phases as a table, as users like to paste it into bug reports
+func phaseTable(phases []singlePhase) []string {
+	border := "+-----+"
+	header := "|value|"
+	for i := range phases {
+		border += "---------------+"
+		header += fmt.Sprintf("   %s  \t|", phaseNames[i])
+	}
+	row := func(label string, value func(L *singlePhase) float64) string {
+		line := "| " + label + " |"
+		for i := range phases {
+			line += fmt.Sprintf(" %8.2f \t|", value(&phases[i]))
+		}
+		return line
+	}
 
-	return &L
-	//log.Println(phase, "Buy: ", float32(binary.BigEndian.Uint32(b[4:8]))/10)
-	//log.Println(phase, "Sell: ", float32(binary.BigEndian.Uint32(b[24:28]))/10)
-	//return
+	return []string{
+		border,
+		header,
+		border,
+		row(" V ", func(L *singlePhase) float64 { return float64(L.voltage) }),
+		row(" A ", func(L *singlePhase) float64 { return float64(L.a) }),
+		row(" W ", func(L *singlePhase) float64 { return float64(L.power) }),
+		row("var", func(L *singlePhase) float64 { return float64(L.reactive) }),
+		row(" VA", func(L *singlePhase) float64 { return float64(L.apparent) }),
+		row(" PF", func(L *singlePhase) float64 { return float64(L.pf) }),
+		row("kWh", func(L *singlePhase) float64 { return L.forward }),
+		row("kWh", func(L *singlePhase) float64 { return L.reverse }),
+		border,
+	}
+}
+
+// powerFactor is P/S, carrying the sign of the active power so that it is positive
+// when buying and negative when selling, as Victron reports it
+func powerFactor(power, apparent float32) float32 {
+	if apparent == 0 {
+		return 0
+	}
+	if apparent < 0 {
+		apparent = -apparent
+	}
+	return power / apparent
 }
 
 func updateVariant(value float64, unit string, path string) {
+	if !roles[cfg.Role].has(path) {
+		return
+	}
+	if unit == "W" && strings.HasSuffix(path, "/Power") {
+		// Only the power itself, not e.g. its watermarks
+		value = averagePower(path, value)
+	}
+	// Venus counts buying from the grid as positive, but not every consumer agrees
+	if (unit == "A" && cfg.InvertCurrent) || (unit == "W" && cfg.InvertPower) {
+		value = -value
+	}
+	if err := checkValue(path, value); err != nil {
+		log.Warnf("Not publishing %s: %v", path, err)
+		return
+	}
 	emit := make(map[string]dbus.Variant)
-	emit["Text"] = dbus.MakeVariant(fmt.Sprintf("%.2f", value) + unit)
+	emit["Text"] = dbus.MakeVariant(formatValue(value, unit))
 	emit["Value"] = dbus.MakeVariant(float64(value))
+	valuesMu.Lock()
 	victronValues[0][objectpath(path)] = emit["Value"]
 	victronValues[1][objectpath(path)] = emit["Text"]
-	conn.Emit(dbus.ObjectPath(path), "com.victronenergy.BusItem.PropertiesChanged", emit)
+	delete(placeholders, objectpath(path))
+	lastEmit = time.Now()
+	valuesMu.Unlock()
+	emitChange(path, emit)
+}
+
+// formatValue is the text published next to value, with the decimals DECIMALS sets for
+// unit, 2 by default
+func formatValue(value float64, unit string) string {
+	decimals, ok := cfg.Decimals[unit]
+	if !ok {
+		decimals = 2
+	}
+	return strconv.FormatFloat(value, 'f', decimals, 64) + unit
+}
+
+// checkValue makes sure value can be published on path. dbus-systemcalc.py and other
+// consumers do arithmetic on these paths and fail on anything but a number, so a path
+// which started out as another type (e.g. /Connected) must not turn into a float, and
+// NaN or infinity must never reach them.
+func checkValue(path string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%v is not a number", value)
+	}
+	valuesMu.RLock()
+	old, ok := victronValues[0][objectpath(path)]
+	valuesMu.RUnlock()
+	if ok {
+		if _, isFloat := old.Value().(float64); !isFloat {
+			return fmt.Errorf("it holds %s, not a float", old.Signature())
+		}
+	}
+	return nil
+}
+
+// emitChange announces a changed path. Older consumers subscribe to PropertiesChanged on
+// every path, newer ones to ItemsChanged on "/", which carries all changes of a datagram
+// at once and is sent by flushItems. DBUS_SIGNALS selects which are sent. With
+// PUBLISH_INTERVAL set, both are held back and sent by publishLoop.
+//
+// PropertiesChanged is sent from the changed path itself, with emit as its only argument:
+// an a{sv} holding "Value" and "Text", which is what the signal handlers of
+// dbus-systemcalc and dbus-mqtt unpack. Both keys must always be there.
+func emitChange(path string, emit map[string]dbus.Variant) {
+	if cfg.Signals != "properties" || cfg.PublishInterval > 0 {
+		valuesMu.Lock()
+		pendingItems[path] = emit
+		valuesMu.Unlock()
+	}
+	if c := busConn(); cfg.Signals != "items" && cfg.PublishInterval == 0 && c != nil {
+		emitSignal(c, dbus.ObjectPath(path), "com.victronenergy.BusItem.PropertiesChanged", emit)
+	}
+}
+
+// flushItems sends everything which changed since the last call as one ItemsChanged
+func flushItems() {
+	if cfg.PublishInterval > 0 {
+		return
+	}
+	sendPending()
+}
+
+// sendPending emits the signals for all changes collected since it last ran. A path
+// which changed several times in between is only sent with its latest value.
+func sendPending() {
+	valuesMu.Lock()
+	items := pendingItems
+	pendingItems = map[string]map[string]dbus.Variant{}
+	valuesMu.Unlock()
+
+	c := busConn()
+	if len(items) == 0 || c == nil {
+		return
+	}
+	if cfg.Signals != "properties" {
+		emitSignal(c, "/", "com.victronenergy.BusItem.ItemsChanged", items)
+	}
+	if cfg.Signals != "items" && cfg.PublishInterval > 0 {
+		for path, emit := range items {
+			emitSignal(c, dbus.ObjectPath(path), "com.victronenergy.BusItem.PropertiesChanged", emit)
+		}
+	}
+}
+
+// publishLoop sends the collected changes once every interval, so a meter sending
+// several updates a second doesn't keep dbus-systemcalc busy
+func publishLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		sendPending()
+	}
+}
+
+// heartbeat re-emits /Ac/Power and /Connected whenever nothing was sent on dbus for
+// the given interval. Otherwise dbus-systemcalc treats a meter on a perfectly quiet
+// grid as stale and drops it.
+func heartbeat(interval time.Duration) {
+	for range time.Tick(interval) {
+		valuesMu.RLock()
+		quiet := time.Since(lastEmit) >= interval
+		valuesMu.RUnlock()
+		if !quiet {
+			continue
+		}
+		log.Debug("No dbus updates in the last ", interval, ", sending heartbeat")
+		reemit("/Ac/Power")
+		reemit("/Connected")
+	}
+}
+
+// markPacket records the arrival of a valid meter datagram, reconnecting the meter
+// if it had been flagged as stale. The first update of a meter logs what it is.
+func markPacket(serial uint32, susyID uint16) {
+	markMeter(strconv.FormatUint(uint64(serial), 10), serial, susyID)
+}
+
+// markMeter is markPacket for any meter, with id the serial to publish on /Serial.
+// Meters without a numeric serial and SUSy ID pass 0 for them, and an empty id leaves
+// /Serial alone.
+func markMeter(id string, serial uint32, susyID uint16) {
+	valuesMu.Lock()
+	lastPacket = time.Now()
+	packetCount++
+	newMeter := id != meterID || susyID != meterSusyID
+	meterSerial, meterSusyID, meterID = serial, susyID, id
+	wasConnected := connected
+	connected = true
+	valuesMu.Unlock()
+
+	if newMeter {
+		log.Infof("Receiving updates from %s, serial %s", describeModel(susyID), id)
+	}
+
+	if !wasConnected {
+		log.Info("Meter updates resumed, marking as connected")
+		resetAverages()
+		setConnected(1)
+	}
+	// Until the first update, /Serial carries a placeholder
+	if id != "" {
+		updateText("/Serial", id)
+	}
+}
+
+// staleWatchdog sets /Connected to 0 when the meter has been silent for longer than
+// timeout, so the ESS doesn't keep regulating on the last known values forever
+func staleWatchdog(timeout time.Duration) {
+	valuesMu.Lock()
+	lastPacket = time.Now()
+	valuesMu.Unlock()
+
+	for now := range time.Tick(time.Second) {
+		checkStale(timeout, now)
+	}
+}
+
+// checkStale marks the meter as disconnected when no update arrived in the timeout
+// before now
+func checkStale(timeout time.Duration, now time.Time) {
+	valuesMu.Lock()
+	stale := connected && now.Sub(lastPacket) > timeout
+	if stale {
+		connected = false
+	}
+	valuesMu.Unlock()
+
+	if stale {
+		log.Warn("No meter updates received for ", timeout, ", marking as disconnected")
+		setConnected(0)
+	}
+}
+
+// updateText publishes a string, emitting only when it actually changed
+func updateText(path string, text string) {
+	valuesMu.Lock()
+	current := victronValues[0][objectpath(path)]
+	if _, isFloat := current.Value().(float64); isFloat {
+		// Consumers calculate with it, a text there would break them
+		valuesMu.Unlock()
+		log.Warnf("Not publishing %s: it holds a number, not a text", path)
+		return
+	}
+	if old, _ := current.Value().(string); old == text {
+		valuesMu.Unlock()
+		return
+	}
+	victronValues[0][objectpath(path)] = dbus.MakeVariant(text)
+	victronValues[1][objectpath(path)] = dbus.MakeVariant(text)
+	delete(placeholders, objectpath(path))
+	valuesMu.Unlock()
+	reemit(path)
+}
+
+func setConnected(v int) {
+	valuesMu.Lock()
+	victronValues[0]["/Connected"] = dbus.MakeVariant(v)
+	victronValues[1]["/Connected"] = dbus.MakeVariant(strconv.Itoa(v))
+	valuesMu.Unlock()
+	takeSnapshot()
+	reemit("/Connected")
+}
+
+// reemit sends PropertiesChanged for the currently stored value of path
+func reemit(path string) {
+	valuesMu.Lock()
+	_, ok := victronValues[0][objectpath(path)]
+	value, text := published(objectpath(path))
+	lastEmit = time.Now()
+	valuesMu.Unlock()
+	if !ok {
+		return
+	}
+	emitChange(path, map[string]dbus.Variant{"Value": value, "Text": text})
+	flushItems()
 }
@@ -0,0 +1,764 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// resetState puts everything a meter update or the dbus setup touches back to how the
+// program starts, with the settings read again from the environment. Set the environment
+// with t.Setenv before calling it.
+func resetState(t testing.TB) {
+	t.Helper()
+	cfg = loadConfig()
+
+	valuesMu.Lock()
+	victronValues[0] = map[objectpath]dbus.Variant{}
+	victronValues[1] = map[objectpath]dbus.Variant{}
+	placeholders = map[objectpath]bool{}
+	pendingItems = map[string]map[string]dbus.Variant{}
+	lastEmit, lastPacket = time.Time{}, time.Time{}
+	packetCount, meterSerial, meterSusyID, meterID = 0, 0, 0, ""
+	connected = true
+	valuesMu.Unlock()
+
+	busMu.Lock()
+	conn, serviceName = nil, ""
+	busMu.Unlock()
+	treeMu.Lock()
+	treePaths, treeNodes = nil, nil
+	treeMu.Unlock()
+	instanceOnce = sync.Once{}
+
+	fewerPhasesLogged, truncatedLogged, energyAbsentLogged, scannedLogged = false, false, false, false
+	firstSerial, mixedSerialsLogged = 0, false
+	lastTicker = 0
+	voltageScale = -1
+	netEncodingSeen = false
+
+	deltaBase, lastDeltaAt = map[string]float64{}, time.Time{}
+	phaseEnergyKnown, phaseEnergyPresent, phaseEnergyZeros = false, false, 0
+	lastEnergy, energyRejects = map[string]float64{}, map[string]int{}
+
+	sessionMu.Lock()
+	sessionForward, sessionReverse, sessionPower = 0, 0, 0
+	sessionLast, sessionStarted = 0, false
+	integratedForward, integratedReverse = 0, 0
+	meterForwardStart, meterReverseStart = 0, 0
+	meterForwardLast, meterReverseLast = 0, 0
+	sessionGap, energyDiverged = false, false
+	sessionMu.Unlock()
+
+	resetAverages()
+	watermarkMu.Lock()
+	powerMin, powerMax = map[int]float64{}, map[int]float64{}
+	watermarkMu.Unlock()
+	stats = datagramStats{}
+}
+
+// loadFixture reads a datagram from testdata, written as hex bytes with # comments
+func loadFixture(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digits strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	b, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return b
+}
+
+// near compares values decoded through float32, which only keeps about 7 digits
+func near(got, want float64) bool {
+	return math.Abs(got-want) <= 1e-6*math.Max(1, math.Abs(want))
+}
+
+// What home-manager-2.hex and home-manager-2-extended.hex decode to
+var (
+	homeManager2Totals = map[string]float64{
+		"power": -3050, "forward": 8765.432, "reverse": 4321.5,
+		"reactive": -120, "apparent": -3100, "frequency": 50.012,
+	}
+	homeManager2Phases = []singlePhase{
+		{voltage: 231.2, a: -6.6, power: -1500, reactive: -60, apparent: -1520, pf: -1500.0 / 1520, forward: 3000.25, reverse: 1500.5},
+		{voltage: 230.4, a: -4.4, power: -1000, reactive: -40, apparent: -1010, pf: -1000.0 / 1010, forward: 2900.125, reverse: 1400.75},
+		{voltage: 229.8, a: -2.5, power: -550, reactive: -20, apparent: -570, pf: -550.0 / 570, forward: 2865, reverse: 1420.25},
+	}
+)
+
+func TestDecodeUpdate(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		firmware string
+		totals   map[string]float64
+		phases   []singlePhase
+	}{
+		{
+			fixture:  "energy-meter.hex",
+			firmware: "1.2.4.R",
+			totals: map[string]float64{
+				"power": 2345.6, "forward": 1234.5, "reverse": 567.8,
+				"reactive": 245.6, "apparent": 2400, "frequency": 49.987,
+			},
+			phases: []singlePhase{
+				{voltage: 229.876, a: 6.543, power: 1500, reactive: 100, apparent: 1530, pf: 1500.0 / 1530, forward: 600.5, reverse: 100.25},
+				{voltage: 231.45, a: -1.1, power: -250, reactive: -50, apparent: -260, pf: -250.0 / 260, forward: 300.75, reverse: 400.5},
+				{voltage: 230.012, a: 4.8, power: 1095.6, reactive: 195.6, apparent: 1130, pf: 1095.6 / 1130, forward: 500.125, reverse: 200},
+			},
+		},
+		{
+			fixture:  "home-manager-2.hex",
+			firmware: "2.3.4.R",
+			totals:   homeManager2Totals,
+			phases:   homeManager2Phases,
+		},
+		{
+			// The same values with entries in between the layout doesn't know
+			fixture:  "home-manager-2-extended.hex",
+			firmware: "2.3.4.R",
+			totals:   homeManager2Totals,
+			phases:   homeManager2Phases,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			resetState(t)
+			b := loadFixture(t, tt.fixture)
+			r, err := decodeUpdate(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !r.energy {
+				t.Error("energy counters not detected")
+			}
+			if r.firmware != tt.firmware {
+				t.Errorf("firmware %q, want %q", r.firmware, tt.firmware)
+			}
+			compareReading(t, r, tt.totals, tt.phases)
+			// The fixtures aren't captures, so also check against what they say
+			// entry by entry, read without the layout
+			totals, phases := referenceDecode(t, b)
+			compareReading(t, r, totals, phases)
+		})
+	}
+}
+
+// compareReading checks the values of r, with totals keyed like the fields of
+// meterReading
+func compareReading(t *testing.T, r meterReading, totals map[string]float64, phases []singlePhase) {
+	t.Helper()
+	got := map[string]float64{
+		"power": float64(r.power), "forward": r.forward, "reverse": r.reverse,
+		"reactive": float64(r.reactive), "apparent": float64(r.apparent), "frequency": r.frequency,
+	}
+	for name, want := range totals {
+		if !near(got[name], want) {
+			t.Errorf("total %s %v, want %v", name, got[name], want)
+		}
+	}
+
+	if len(r.phases) != len(phases) {
+		t.Fatalf("%d phases, want %d", len(r.phases), len(phases))
+	}
+	for i, want := range phases {
+		L := r.phases[i]
+		fields := []struct {
+			name      string
+			got, want float64
+		}{
+			{"voltage", float64(L.voltage), float64(want.voltage)},
+			{"current", float64(L.a), float64(want.a)},
+			{"power", float64(L.power), float64(want.power)},
+			{"reactive", float64(L.reactive), float64(want.reactive)},
+			{"apparent", float64(L.apparent), float64(want.apparent)},
+			{"power factor", float64(L.pf), float64(want.pf)},
+			{"forward", L.forward, want.forward},
+			{"reverse", L.reverse, want.reverse},
+		}
+		for _, f := range fields {
+			if !near(f.got, f.want) {
+				t.Errorf("%s %s %v, want %v", phaseNames[i], f.name, f.got, f.want)
+			}
+		}
+	}
+}
+
+// referenceDecode reads a meter update the way SMA describes the protocol, without
+// any of the decoder's offsets: OBIS entries one after the other from the end of the
+// header, each found by its code. Powers are in 0.1 W (var, VA), energies in Ws,
+// currents in mA, voltages in mV and the frequency in mHz, signed by which of the
+// bought or sold halves holds the value.
+func referenceDecode(t *testing.T, b []byte) (totals map[string]float64, phases []singlePhase) {
+	t.Helper()
+	entries := map[string]uint64{}
+	for at := headerLen + 4; ; {
+		if at+4 > len(b) {
+			t.Fatalf("no end marker")
+		}
+		code := binary.BigEndian.Uint32(b[at:])
+		if code == 0 {
+			break
+		}
+		if code == 0x90000000 {
+			at += 8
+			continue
+		}
+		channel, size := b[at+1], int(b[at+2])
+		v := uint64(binary.BigEndian.Uint32(b[at+4:]))
+		if size == 8 {
+			v = binary.BigEndian.Uint64(b[at+4:])
+		}
+		entries[fmt.Sprintf("1:%d.%d.0", channel, size)] = v
+		at += 4 + size
+	}
+	// value is bought minus sold of the pair of channels starting at bought
+	value := func(bought int, size int, unit float64) float64 {
+		return (float64(entries[fmt.Sprintf("1:%d.%d.0", bought, size)]) -
+			float64(entries[fmt.Sprintf("1:%d.%d.0", bought+1, size)])) / unit
+	}
+	totals = map[string]float64{
+		"power":     value(1, 4, 10),
+		"forward":   float64(entries["1:1.8.0"]) / 3600000,
+		"reverse":   float64(entries["1:2.8.0"]) / 3600000,
+		"reactive":  value(3, 4, 10),
+		"apparent":  value(9, 4, 10),
+		"frequency": float64(entries["1:14.4.0"]) / 1000,
+	}
+	for i := 0; i < 3; i++ {
+		base := 20 * (i + 1)
+		L := singlePhase{
+			power:    float32(value(base+1, 4, 10)),
+			reactive: float32(value(base+3, 4, 10)),
+			apparent: float32(value(base+9, 4, 10)),
+			a:        float32(entries[fmt.Sprintf("1:%d.4.0", base+11)]) / 1000,
+			voltage:  float32(entries[fmt.Sprintf("1:%d.4.0", base+12)]) / 1000,
+			forward:  float64(entries[fmt.Sprintf("1:%d.8.0", base+1)]) / 3600000,
+			reverse:  float64(entries[fmt.Sprintf("1:%d.8.0", base+2)]) / 3600000,
+		}
+		if L.power < 0 {
+			L.a = -L.a
+		}
+		L.pf = L.power / float32(math.Abs(float64(L.apparent)))
+		phases = append(phases, L)
+	}
+	return totals, phases
+}
+
+func BenchmarkDecodeUpdate(b *testing.B) {
+	resetState(b)
+	datagram := loadFixture(b, "energy-meter.hex")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeUpdate(datagram); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMsgHandler(b *testing.B) {
+	resetState(b)
+	setupValues(roles[cfg.Role])
+	// Not the cost of writing the log, every update is logged at info level
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+	datagram := loadFixture(b, "energy-meter.hex")
+	buf := make([]byte, maxDatagramSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// The listener hands over its one receive buffer, the ticker moves on every update
+		n := copy(buf, datagram)
+		binary.BigEndian.PutUint32(buf[24:28], uint32(i)*1000)
+		msgHandler(nil, n, buf)
+	}
+}
+
+func TestPhaseEnergy(t *testing.T) {
+	// The per-phase counters are 1:21.8.0 and 1:22.8.0 for L1, 20 channels further for
+	// each phase after it. They are found by their codes here, not at the offsets the
+	// decoder reads them from.
+	for _, fixture := range []string{"energy-meter.hex", "home-manager-2.hex", "home-manager-2-extended.hex"} {
+		t.Run(fixture, func(t *testing.T) {
+			resetState(t)
+			setupValues(roles[cfg.Role])
+			b := loadFixture(t, fixture)
+			_, want := referenceDecode(t, b)
+			msgHandler(nil, len(b), b)
+			for i, L := range want {
+				for path, kWh := range map[string]float64{
+					"/Ac/" + phaseNames[i] + "/Energy/Forward": L.forward,
+					"/Ac/" + phaseNames[i] + "/Energy/Reverse": L.reverse,
+				} {
+					if kWh == 0 {
+						t.Fatalf("%s has no %s to check", fixture, path)
+					}
+					if got := publishedValue(t, path); !near(got, kWh) {
+						t.Errorf("%s %v, want %v", path, got, kWh)
+					}
+				}
+			}
+		})
+	}
+}
+
+// publishedValue is the value last published on path
+func publishedValue(t *testing.T, path string) float64 {
+	t.Helper()
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
+	if placeholders[objectpath(path)] {
+		t.Fatalf("%s was never published", path)
+	}
+	v, ok := victronValues[0][objectpath(path)].Value().(float64)
+	if !ok {
+		t.Fatalf("%s holds %v, not a number", path, victronValues[0][objectpath(path)])
+	}
+	return v
+}
+
+func TestPowerSign(t *testing.T) {
+	tests := []struct {
+		fixture string
+		power   float64
+	}{
+		{"energy-meter.hex", 2345.6},  // buying from the grid
+		{"home-manager-2.hex", -3050}, // selling to it
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			resetState(t)
+			setupValues(roles[cfg.Role])
+			b := loadFixture(t, tt.fixture)
+			msgHandler(nil, len(b), b)
+			if got := publishedValue(t, "/Ac/Power"); !near(got, tt.power) {
+				t.Errorf("/Ac/Power %v, want %v", got, tt.power)
+			}
+		})
+	}
+}
+
+func TestReactiveLoadCurrent(t *testing.T) {
+	// A reactive load of 1150 W at a power factor of 0.5 draws 10 A at 230 V, not the 5 A
+	// the power alone gives
+	tests := []struct {
+		name     string
+		reported float64 // A the meter sends, 0 for none
+		power    float64
+		current  float32
+	}{
+		{"reported", 10, 1150, 10},
+		{"from the apparent power", 0, 1150, 10},
+		{"reported while selling", 10, -1150, -10},
+		{"from the apparent power while selling", 0, -1150, -10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState(t)
+			b := make([]byte, phaseLen)
+			encodeFields(b, speedwirePhase, map[quantity]float64{
+				qPower:         tt.power,
+				qApparentPower: math.Copysign(2300, tt.power),
+				qVoltage:       230,
+				qCurrent:       tt.reported,
+			}, 0)
+			L := decodePhaseChunk(b, models[349])
+			if !near(float64(L.a), float64(tt.current)) {
+				t.Errorf("current %v, want %v", L.a, tt.current)
+			}
+		})
+	}
+}
+
+func TestVoltageScale(t *testing.T) {
+	// The raw values all mean 230 V, the second update 231 V
+	tests := []struct {
+		unit       string
+		raw, next  float32 // as decoded in mV
+		scaleIndex int
+	}{
+		{"mV", 230, 231, 0},
+		{"V", 0.230, 0.231, 1},
+		{"0.1 V", 2.30, 2.31, 2},
+		{"0.01 V", 23.0, 23.1, 3},
+	}
+	model := models[270] // the Energy Meter doesn't know its unit
+	for _, tt := range tests {
+		t.Run(tt.unit, func(t *testing.T) {
+			resetState(t)
+			// SHM1.0 sends 0 V, which mustn't decide the unit
+			if v := scaleVoltage(0, model); v != 0 || voltageScale != -1 {
+				t.Fatalf("0 V scaled to %v, unit %d decided", v, voltageScale)
+			}
+			if v := scaleVoltage(tt.raw, model); !near(float64(v), 230) {
+				t.Errorf("first voltage %v, want 230", v)
+			}
+			if voltageScale != tt.scaleIndex {
+				t.Errorf("unit %s detected, want %s", voltageScales[voltageScale].unit, tt.unit)
+			}
+			if v := scaleVoltage(tt.next, model); !near(float64(v), 231) {
+				t.Errorf("second voltage %v, want 231", v)
+			}
+		})
+	}
+
+	t.Run("implausible", func(t *testing.T) {
+		resetState(t)
+		if v := scaleVoltage(5, model); v != 5 || voltageScale != -1 {
+			t.Errorf("5 scaled to %v, unit %d decided", v, voltageScale)
+		}
+	})
+}
+
+func TestMeterUpdateFilter(t *testing.T) {
+	tests := []struct {
+		fixture string
+		err     error // nil for a meter update
+	}{
+		{"energy-meter.hex", nil},
+		{"home-manager-2.hex", nil},
+		{"inverter-broadcast.hex", errWrongMagic},
+		{"discovery-reply.hex", errWrongMagic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			resetState(t)
+			b := loadFixture(t, tt.fixture)
+			_, err := decodeUpdate(b)
+			if tt.err == nil && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if tt.err != nil && !strings.Contains(err.Error(), fmt.Sprintf("% x", b[:18])) {
+				t.Errorf("%q doesn't show the header bytes", err)
+			}
+		})
+	}
+}
+
+func TestInvert(t *testing.T) {
+	tests := []struct {
+		power, current bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("power %v current %v", tt.power, tt.current), func(t *testing.T) {
+			t.Setenv("INVERT_POWER", strconv.FormatBool(tt.power))
+			t.Setenv("INVERT_CURRENT", strconv.FormatBool(tt.current))
+			resetState(t)
+			setupValues(roles[cfg.Role])
+			// L2 sells 250 W, then 1000 W
+			for _, fixture := range []string{"energy-meter.hex", "home-manager-2.hex"} {
+				b := loadFixture(t, fixture)
+				msgHandler(nil, len(b), b)
+			}
+
+			powerSign, currentSign := 1.0, 1.0
+			if tt.power {
+				powerSign = -1
+			}
+			if tt.current {
+				currentSign = -1
+			}
+			want := map[string]float64{
+				"/Ac/Power":             -3050 * powerSign,
+				"/Ac/L2/Power":          -1000 * powerSign,
+				"/Ac/L2/Current":        -4.4 * currentSign,
+				"/Debug/Ac/L2/PowerMin": -1000,
+				"/Debug/Ac/L2/PowerMax": -250,
+			}
+			if tt.power {
+				// Of the values as published
+				want["/Debug/Ac/L2/PowerMin"] = 250
+				want["/Debug/Ac/L2/PowerMax"] = 1000
+			}
+			for path, w := range want {
+				if got := publishedValue(t, path); !near(got, w) {
+					t.Errorf("%s %v, want %v", path, got, w)
+				}
+			}
+		})
+	}
+}
+
+func TestPhaseCurrentSign(t *testing.T) {
+	tests := []struct {
+		name                     string
+		meterA                   float32
+		power, apparent, voltage float32
+		want                     float32
+	}{
+		{"reported while buying", 5, 1150, 1150, 230, 5},
+		{"reported while selling", 5, -1150, -1150, 230, -5},
+		{"from the apparent power while selling", 0, -1150, -1150, 230, -5},
+		{"from the power while buying", 0, 1150, 0, 230, 5},
+		{"from the power while selling", 0, -1150, 0, 230, -5},
+		{"without a voltage", 0, 1150, 1150, 0, 0}, // SHM1.0, no division by zero
+	}
+	for _, tt := range tests {
+		L := singlePhase{power: tt.power, apparent: tt.apparent, voltage: tt.voltage}
+		L.setCurrent(tt.meterA)
+		if !near(float64(L.a), float64(tt.want)) {
+			t.Errorf("%s: %v A, want %v", tt.name, L.a, tt.want)
+		}
+	}
+}
+
+func TestPowerFactor(t *testing.T) {
+	tests := []struct {
+		power, apparent, want float32
+	}{
+		{1000, 1250, 0.8},
+		{-1000, 1250, -0.8}, // signed like the power
+		{-1000, -1250, -0.8},
+		{500, 0, 0}, // nothing measured, no division by zero
+	}
+	for _, tt := range tests {
+		if got := powerFactor(tt.power, tt.apparent); !near(float64(got), float64(tt.want)) {
+			t.Errorf("%v W at %v VA: power factor %v, want %v", tt.power, tt.apparent, got, tt.want)
+		}
+	}
+
+	// Published for the total and every phase
+	resetState(t)
+	setupValues(roles[cfg.Role])
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b), b)
+	want := map[string]float64{
+		"/Ac/PowerFactor":    2345.6 / 2400,
+		"/Ac/L1/PowerFactor": 1500.0 / 1530,
+		"/Ac/L2/PowerFactor": -250.0 / 260,
+		"/Ac/L3/PowerFactor": 1095.6 / 1130,
+	}
+	for path, w := range want {
+		if got := publishedValue(t, path); !near(got, w) {
+			t.Errorf("%s %v, want %v", path, got, w)
+		}
+	}
+}
+
+func TestStaleWatchdog(t *testing.T) {
+	resetState(t)
+	setupValues(roles[cfg.Role])
+	timeout := 10 * time.Second
+	isConnected := func() int {
+		t.Helper()
+		valuesMu.RLock()
+		defer valuesMu.RUnlock()
+		v, _ := victronValues[0]["/Connected"].Value().(int)
+		return v
+	}
+
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b), b)
+	checkStale(timeout, time.Now())
+	if v := isConnected(); v != 1 {
+		t.Fatalf("/Connected %d right after an update, want 1", v)
+	}
+
+	checkStale(timeout, time.Now().Add(timeout+time.Second))
+	if v := isConnected(); v != 0 {
+		t.Fatalf("/Connected %d after %v without updates, want 0", v, timeout)
+	}
+
+	// The next update brings it back
+	binary.BigEndian.PutUint32(b[24:28], binary.BigEndian.Uint32(b[24:28])+1000)
+	msgHandler(nil, len(b), b)
+	if v := isConnected(); v != 1 {
+		t.Errorf("/Connected %d after updates resumed, want 1", v)
+	}
+}
+
+func TestApparentPowerTotal(t *testing.T) {
+	resetState(t)
+	setupValues(roles[cfg.Role])
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b), b)
+
+	total := publishedValue(t, "/Ac/ApparentPower")
+	if !near(total, 2400) {
+		t.Errorf("/Ac/ApparentPower %v, want 2400", total)
+	}
+	var sum float64
+	for _, phase := range []string{"L1", "L2", "L3"} {
+		sum += publishedValue(t, "/Ac/"+phase+"/ApparentPower")
+	}
+	if !near(sum, total) {
+		t.Errorf("phases add up to %v VA, but the total is %v VA", sum, total)
+	}
+}
+
+func TestTruncatedUpdate(t *testing.T) {
+	resetState(t)
+	setupValues(roles[cfg.Role])
+	if cfg.Phases != 3 {
+		t.Fatalf("PHASES %d, the test needs the default of 3", cfg.Phases)
+	}
+
+	// Cut off in the middle of L3
+	b := loadFixture(t, "energy-meter.hex")[:520]
+	msgHandler(nil, len(b), b)
+
+	if s := stats.snapshot(); s.short != 1 || s.decoded != 0 {
+		t.Errorf("%d short and %d decoded datagrams, want 1 short and none decoded", s.short, s.decoded)
+	}
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
+	if !placeholders["/Ac/Power"] {
+		t.Errorf("/Ac/Power published from a truncated update: %v", victronValues[0]["/Ac/Power"])
+	}
+}
+
+func TestFewerPhases(t *testing.T) {
+	voltages := []float64{229.876, 231.45, 230.012}
+	for _, phases := range []int{1, 2} {
+		t.Run(strconv.Itoa(phases), func(t *testing.T) {
+			t.Setenv("PHASES", strconv.Itoa(phases))
+			resetState(t)
+			_, updatingPaths := setupValues(roles[cfg.Role])
+			b := loadFixture(t, "energy-meter.hex")
+			msgHandler(nil, len(b), b)
+
+			// The totals are over the phases in use only, the meter's L3 is ignored
+			var voltage, current float64
+			for i, phase := range phaseNames[:phases] {
+				voltage += voltages[i]
+				current += publishedValue(t, "/Ac/"+phase+"/Current")
+			}
+			if got := publishedValue(t, "/Ac/Voltage"); !near(got, voltage/float64(phases)) {
+				t.Errorf("/Ac/Voltage %v, want the average %v", got, voltage/float64(phases))
+			}
+			if got := publishedValue(t, "/Ac/Current"); !near(got, current) {
+				t.Errorf("/Ac/Current %v, want the sum %v", got, current)
+			}
+
+			for _, p := range updatingPaths {
+				if strings.HasPrefix(string(p), "/Ac/L3/") {
+					t.Errorf("%s exported with PHASES=%d", p, phases)
+				}
+			}
+			valuesMu.RLock()
+			defer valuesMu.RUnlock()
+			for path := range victronValues[0] {
+				if strings.HasPrefix(string(path), "/Ac/L3/") {
+					t.Errorf("%s published with PHASES=%d", path, phases)
+				}
+			}
+		})
+	}
+}
+
+func TestLineVoltage(t *testing.T) {
+	resetState(t)
+	setupValues(roles[cfg.Role])
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b), b)
+
+	// From the phase voltages, 120° apart: |a - b| = √(a² + b² + ab)
+	L1, L2, L3 := 229.876, 231.45, 230.012
+	for path, want := range map[string]float64{
+		"/Ac/L1L2/Voltage": math.Sqrt(L1*L1 + L2*L2 + L1*L2),
+		"/Ac/L2L3/Voltage": math.Sqrt(L2*L2 + L3*L3 + L2*L3),
+		"/Ac/L3L1/Voltage": math.Sqrt(L3*L3 + L1*L1 + L3*L1),
+	} {
+		if got := publishedValue(t, path); !near(got, want) {
+			t.Errorf("%s %v, want %v", path, got, want)
+		}
+	}
+
+	// Without three phases there is nothing between them
+	t.Setenv("PHASES", "2")
+	resetState(t)
+	_, updatingPaths := setupValues(roles[cfg.Role])
+	for _, p := range updatingPaths {
+		for _, pair := range lineToLine {
+			if string(p) == lineVoltagePath(pair) {
+				t.Errorf("%s exported with PHASES=2", p)
+			}
+		}
+	}
+}
+
+func TestLengthBeyondBuffer(t *testing.T) {
+	resetState(t)
+	setupValues(roles[cfg.Role])
+
+	// A length the buffer can't hold is cut to the buffer, not taken as nothing received
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b)+100, b)
+	if s := stats.snapshot(); s.decoded != 1 || s.filtered != 0 {
+		t.Errorf("%d decoded and %d filtered datagrams, want 1 decoded", s.decoded, s.filtered)
+	}
+}
+
+func TestSnapshotConsistent(t *testing.T) {
+	resetState(t)
+	setupValues(roles[cfg.Role])
+
+	// The total is always three times L1, so a snapshot mixing two updates shows up
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			phase := singlePhase{voltage: 230, power: float32(i)}
+			publishReading(meterReading{power: float32(3 * i), phases: []singlePhase{phase, phase, phase}})
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		values := snapshotValues()
+		total, ok1 := values["/Ac/Power"]
+		l1, ok2 := values["/Ac/L1/Power"]
+		if ok1 && ok2 && !near(total, 3*l1) {
+			t.Fatalf("/Ac/Power %v and /Ac/L1/Power %v are from different updates", total, l1)
+		}
+	}
+}
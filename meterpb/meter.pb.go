@@ -0,0 +1,489 @@
+// The gRPC service shm-et340 serves on GRPC_ADDR, for dashboards and other clients which
+// want every meter update as it arrives. Generate a client from this file with protoc
+// for the language of your choice, the Go code in this directory is generated from it
+// with go generate.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.33.0
+// 	protoc        (unknown)
+// source: meter.proto
+
+package meterpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type SubscribeRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_meter_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_meter_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_meter_proto_rawDescGZIP(), []int{0}
+}
+
+// MeterReading holds the values as published on dbus, with the same signs and units:
+// power positive when buying, energy in kWh. Values not published, e.g. before the first
+// update, are left out.
+type MeterReading struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Serial        uint32   `protobuf:"varint,1,opt,name=serial,proto3" json:"serial,omitempty"`
+	TimestampMs   *int64   `protobuf:"varint,2,opt,name=timestamp_ms,json=timestampMs,proto3,oneof" json:"timestamp_ms,omitempty"`        // when the update arrived, in ms since 1970
+	Power         *float64 `protobuf:"fixed64,3,opt,name=power,proto3,oneof" json:"power,omitempty"`                                      // W
+	Current       *float64 `protobuf:"fixed64,4,opt,name=current,proto3,oneof" json:"current,omitempty"`                                  // A
+	Voltage       *float64 `protobuf:"fixed64,5,opt,name=voltage,proto3,oneof" json:"voltage,omitempty"`                                  // V, average of the phases
+	Frequency     *float64 `protobuf:"fixed64,6,opt,name=frequency,proto3,oneof" json:"frequency,omitempty"`                              // Hz
+	ReactivePower *float64 `protobuf:"fixed64,7,opt,name=reactive_power,json=reactivePower,proto3,oneof" json:"reactive_power,omitempty"` // var
+	ApparentPower *float64 `protobuf:"fixed64,8,opt,name=apparent_power,json=apparentPower,proto3,oneof" json:"apparent_power,omitempty"` // VA
+	PowerFactor   *float64 `protobuf:"fixed64,9,opt,name=power_factor,json=powerFactor,proto3,oneof" json:"power_factor,omitempty"`
+	EnergyForward *float64 `protobuf:"fixed64,10,opt,name=energy_forward,json=energyForward,proto3,oneof" json:"energy_forward,omitempty"` // kWh bought
+	EnergyReverse *float64 `protobuf:"fixed64,11,opt,name=energy_reverse,json=energyReverse,proto3,oneof" json:"energy_reverse,omitempty"` // kWh sold
+	Phases        []*Phase `protobuf:"bytes,12,rep,name=phases,proto3" json:"phases,omitempty"`
+}
+
+func (x *MeterReading) Reset() {
+	*x = MeterReading{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_meter_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MeterReading) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MeterReading) ProtoMessage() {}
+
+func (x *MeterReading) ProtoReflect() protoreflect.Message {
+	mi := &file_meter_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MeterReading.ProtoReflect.Descriptor instead.
+func (*MeterReading) Descriptor() ([]byte, []int) {
+	return file_meter_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *MeterReading) GetSerial() uint32 {
+	if x != nil {
+		return x.Serial
+	}
+	return 0
+}
+
+func (x *MeterReading) GetTimestampMs() int64 {
+	if x != nil && x.TimestampMs != nil {
+		return *x.TimestampMs
+	}
+	return 0
+}
+
+func (x *MeterReading) GetPower() float64 {
+	if x != nil && x.Power != nil {
+		return *x.Power
+	}
+	return 0
+}
+
+func (x *MeterReading) GetCurrent() float64 {
+	if x != nil && x.Current != nil {
+		return *x.Current
+	}
+	return 0
+}
+
+func (x *MeterReading) GetVoltage() float64 {
+	if x != nil && x.Voltage != nil {
+		return *x.Voltage
+	}
+	return 0
+}
+
+func (x *MeterReading) GetFrequency() float64 {
+	if x != nil && x.Frequency != nil {
+		return *x.Frequency
+	}
+	return 0
+}
+
+func (x *MeterReading) GetReactivePower() float64 {
+	if x != nil && x.ReactivePower != nil {
+		return *x.ReactivePower
+	}
+	return 0
+}
+
+func (x *MeterReading) GetApparentPower() float64 {
+	if x != nil && x.ApparentPower != nil {
+		return *x.ApparentPower
+	}
+	return 0
+}
+
+func (x *MeterReading) GetPowerFactor() float64 {
+	if x != nil && x.PowerFactor != nil {
+		return *x.PowerFactor
+	}
+	return 0
+}
+
+func (x *MeterReading) GetEnergyForward() float64 {
+	if x != nil && x.EnergyForward != nil {
+		return *x.EnergyForward
+	}
+	return 0
+}
+
+func (x *MeterReading) GetEnergyReverse() float64 {
+	if x != nil && x.EnergyReverse != nil {
+		return *x.EnergyReverse
+	}
+	return 0
+}
+
+func (x *MeterReading) GetPhases() []*Phase {
+	if x != nil {
+		return x.Phases
+	}
+	return nil
+}
+
+type Phase struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name          string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"` // L1 to L3
+	Power         *float64 `protobuf:"fixed64,2,opt,name=power,proto3,oneof" json:"power,omitempty"`
+	Current       *float64 `protobuf:"fixed64,3,opt,name=current,proto3,oneof" json:"current,omitempty"`
+	Voltage       *float64 `protobuf:"fixed64,4,opt,name=voltage,proto3,oneof" json:"voltage,omitempty"`
+	ReactivePower *float64 `protobuf:"fixed64,5,opt,name=reactive_power,json=reactivePower,proto3,oneof" json:"reactive_power,omitempty"`
+	ApparentPower *float64 `protobuf:"fixed64,6,opt,name=apparent_power,json=apparentPower,proto3,oneof" json:"apparent_power,omitempty"`
+	PowerFactor   *float64 `protobuf:"fixed64,7,opt,name=power_factor,json=powerFactor,proto3,oneof" json:"power_factor,omitempty"`
+	EnergyForward *float64 `protobuf:"fixed64,8,opt,name=energy_forward,json=energyForward,proto3,oneof" json:"energy_forward,omitempty"`
+	EnergyReverse *float64 `protobuf:"fixed64,9,opt,name=energy_reverse,json=energyReverse,proto3,oneof" json:"energy_reverse,omitempty"`
+}
+
+func (x *Phase) Reset() {
+	*x = Phase{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_meter_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Phase) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Phase) ProtoMessage() {}
+
+func (x *Phase) ProtoReflect() protoreflect.Message {
+	mi := &file_meter_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Phase.ProtoReflect.Descriptor instead.
+func (*Phase) Descriptor() ([]byte, []int) {
+	return file_meter_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Phase) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Phase) GetPower() float64 {
+	if x != nil && x.Power != nil {
+		return *x.Power
+	}
+	return 0
+}
+
+func (x *Phase) GetCurrent() float64 {
+	if x != nil && x.Current != nil {
+		return *x.Current
+	}
+	return 0
+}
+
+func (x *Phase) GetVoltage() float64 {
+	if x != nil && x.Voltage != nil {
+		return *x.Voltage
+	}
+	return 0
+}
+
+func (x *Phase) GetReactivePower() float64 {
+	if x != nil && x.ReactivePower != nil {
+		return *x.ReactivePower
+	}
+	return 0
+}
+
+func (x *Phase) GetApparentPower() float64 {
+	if x != nil && x.ApparentPower != nil {
+		return *x.ApparentPower
+	}
+	return 0
+}
+
+func (x *Phase) GetPowerFactor() float64 {
+	if x != nil && x.PowerFactor != nil {
+		return *x.PowerFactor
+	}
+	return 0
+}
+
+func (x *Phase) GetEnergyForward() float64 {
+	if x != nil && x.EnergyForward != nil {
+		return *x.EnergyForward
+	}
+	return 0
+}
+
+func (x *Phase) GetEnergyReverse() float64 {
+	if x != nil && x.EnergyReverse != nil {
+		return *x.EnergyReverse
+	}
+	return 0
+}
+
+var File_meter_proto protoreflect.FileDescriptor
+
+var file_meter_proto_rawDesc = []byte{
+	0x0a, 0x0b, 0x6d, 0x65, 0x74, 0x65, 0x72, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x08, 0x73,
+	0x68, 0x6d, 0x65, 0x74, 0x33, 0x34, 0x30, 0x22, 0x12, 0x0a, 0x10, 0x53, 0x75, 0x62, 0x73, 0x63,
+	0x72, 0x69, 0x62, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0xe9, 0x04, 0x0a, 0x0c,
+	0x4d, 0x65, 0x74, 0x65, 0x72, 0x52, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x16, 0x0a, 0x06,
+	0x73, 0x65, 0x72, 0x69, 0x61, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x73, 0x65,
+	0x72, 0x69, 0x61, 0x6c, 0x12, 0x26, 0x0a, 0x0c, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
+	0x70, 0x5f, 0x6d, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x48, 0x00, 0x52, 0x0b, 0x74, 0x69,
+	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x4d, 0x73, 0x88, 0x01, 0x01, 0x12, 0x19, 0x0a, 0x05,
+	0x70, 0x6f, 0x77, 0x65, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x01, 0x48, 0x01, 0x52, 0x05, 0x70,
+	0x6f, 0x77, 0x65, 0x72, 0x88, 0x01, 0x01, 0x12, 0x1d, 0x0a, 0x07, 0x63, 0x75, 0x72, 0x72, 0x65,
+	0x6e, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x01, 0x48, 0x02, 0x52, 0x07, 0x63, 0x75, 0x72, 0x72,
+	0x65, 0x6e, 0x74, 0x88, 0x01, 0x01, 0x12, 0x1d, 0x0a, 0x07, 0x76, 0x6f, 0x6c, 0x74, 0x61, 0x67,
+	0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x48, 0x03, 0x52, 0x07, 0x76, 0x6f, 0x6c, 0x74, 0x61,
+	0x67, 0x65, 0x88, 0x01, 0x01, 0x12, 0x21, 0x0a, 0x09, 0x66, 0x72, 0x65, 0x71, 0x75, 0x65, 0x6e,
+	0x63, 0x79, 0x18, 0x06, 0x20, 0x01, 0x28, 0x01, 0x48, 0x04, 0x52, 0x09, 0x66, 0x72, 0x65, 0x71,
+	0x75, 0x65, 0x6e, 0x63, 0x79, 0x88, 0x01, 0x01, 0x12, 0x2a, 0x0a, 0x0e, 0x72, 0x65, 0x61, 0x63,
+	0x74, 0x69, 0x76, 0x65, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x18, 0x07, 0x20, 0x01, 0x28, 0x01,
+	0x48, 0x05, 0x52, 0x0d, 0x72, 0x65, 0x61, 0x63, 0x74, 0x69, 0x76, 0x65, 0x50, 0x6f, 0x77, 0x65,
+	0x72, 0x88, 0x01, 0x01, 0x12, 0x2a, 0x0a, 0x0e, 0x61, 0x70, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74,
+	0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x18, 0x08, 0x20, 0x01, 0x28, 0x01, 0x48, 0x06, 0x52, 0x0d,
+	0x61, 0x70, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x50, 0x6f, 0x77, 0x65, 0x72, 0x88, 0x01, 0x01,
+	0x12, 0x26, 0x0a, 0x0c, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x5f, 0x66, 0x61, 0x63, 0x74, 0x6f, 0x72,
+	0x18, 0x09, 0x20, 0x01, 0x28, 0x01, 0x48, 0x07, 0x52, 0x0b, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x46,
+	0x61, 0x63, 0x74, 0x6f, 0x72, 0x88, 0x01, 0x01, 0x12, 0x2a, 0x0a, 0x0e, 0x65, 0x6e, 0x65, 0x72,
+	0x67, 0x79, 0x5f, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x01,
+	0x48, 0x08, 0x52, 0x0d, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x46, 0x6f, 0x72, 0x77, 0x61, 0x72,
+	0x64, 0x88, 0x01, 0x01, 0x12, 0x2a, 0x0a, 0x0e, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x5f, 0x72,
+	0x65, 0x76, 0x65, 0x72, 0x73, 0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x01, 0x48, 0x09, 0x52, 0x0d,
+	0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x52, 0x65, 0x76, 0x65, 0x72, 0x73, 0x65, 0x88, 0x01, 0x01,
+	0x12, 0x27, 0x0a, 0x06, 0x70, 0x68, 0x61, 0x73, 0x65, 0x73, 0x18, 0x0c, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x0f, 0x2e, 0x73, 0x68, 0x6d, 0x65, 0x74, 0x33, 0x34, 0x30, 0x2e, 0x50, 0x68, 0x61, 0x73,
+	0x65, 0x52, 0x06, 0x70, 0x68, 0x61, 0x73, 0x65, 0x73, 0x42, 0x0f, 0x0a, 0x0d, 0x5f, 0x74, 0x69,
+	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x5f, 0x6d, 0x73, 0x42, 0x08, 0x0a, 0x06, 0x5f, 0x70,
+	0x6f, 0x77, 0x65, 0x72, 0x42, 0x0a, 0x0a, 0x08, 0x5f, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74,
+	0x42, 0x0a, 0x0a, 0x08, 0x5f, 0x76, 0x6f, 0x6c, 0x74, 0x61, 0x67, 0x65, 0x42, 0x0c, 0x0a, 0x0a,
+	0x5f, 0x66, 0x72, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x79, 0x42, 0x11, 0x0a, 0x0f, 0x5f, 0x72,
+	0x65, 0x61, 0x63, 0x74, 0x69, 0x76, 0x65, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x42, 0x11, 0x0a,
+	0x0f, 0x5f, 0x61, 0x70, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72,
+	0x42, 0x0f, 0x0a, 0x0d, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x5f, 0x66, 0x61, 0x63, 0x74, 0x6f,
+	0x72, 0x42, 0x11, 0x0a, 0x0f, 0x5f, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x5f, 0x66, 0x6f, 0x72,
+	0x77, 0x61, 0x72, 0x64, 0x42, 0x11, 0x0a, 0x0f, 0x5f, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x5f,
+	0x72, 0x65, 0x76, 0x65, 0x72, 0x73, 0x65, 0x22, 0xcb, 0x03, 0x0a, 0x05, 0x50, 0x68, 0x61, 0x73,
+	0x65, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x19, 0x0a, 0x05, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x01, 0x48, 0x00, 0x52, 0x05, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x88, 0x01, 0x01,
+	0x12, 0x1d, 0x0a, 0x07, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x01, 0x48, 0x01, 0x52, 0x07, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x88, 0x01, 0x01, 0x12,
+	0x1d, 0x0a, 0x07, 0x76, 0x6f, 0x6c, 0x74, 0x61, 0x67, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x01,
+	0x48, 0x02, 0x52, 0x07, 0x76, 0x6f, 0x6c, 0x74, 0x61, 0x67, 0x65, 0x88, 0x01, 0x01, 0x12, 0x2a,
+	0x0a, 0x0e, 0x72, 0x65, 0x61, 0x63, 0x74, 0x69, 0x76, 0x65, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x48, 0x03, 0x52, 0x0d, 0x72, 0x65, 0x61, 0x63, 0x74, 0x69,
+	0x76, 0x65, 0x50, 0x6f, 0x77, 0x65, 0x72, 0x88, 0x01, 0x01, 0x12, 0x2a, 0x0a, 0x0e, 0x61, 0x70,
+	0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x01, 0x48, 0x04, 0x52, 0x0d, 0x61, 0x70, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x50, 0x6f,
+	0x77, 0x65, 0x72, 0x88, 0x01, 0x01, 0x12, 0x26, 0x0a, 0x0c, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x5f,
+	0x66, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x07, 0x20, 0x01, 0x28, 0x01, 0x48, 0x05, 0x52, 0x0b,
+	0x70, 0x6f, 0x77, 0x65, 0x72, 0x46, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x88, 0x01, 0x01, 0x12, 0x2a,
+	0x0a, 0x0e, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x5f, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64,
+	0x18, 0x08, 0x20, 0x01, 0x28, 0x01, 0x48, 0x06, 0x52, 0x0d, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79,
+	0x46, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x88, 0x01, 0x01, 0x12, 0x2a, 0x0a, 0x0e, 0x65, 0x6e,
+	0x65, 0x72, 0x67, 0x79, 0x5f, 0x72, 0x65, 0x76, 0x65, 0x72, 0x73, 0x65, 0x18, 0x09, 0x20, 0x01,
+	0x28, 0x01, 0x48, 0x07, 0x52, 0x0d, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x52, 0x65, 0x76, 0x65,
+	0x72, 0x73, 0x65, 0x88, 0x01, 0x01, 0x42, 0x08, 0x0a, 0x06, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72,
+	0x42, 0x0a, 0x0a, 0x08, 0x5f, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x42, 0x0a, 0x0a, 0x08,
+	0x5f, 0x76, 0x6f, 0x6c, 0x74, 0x61, 0x67, 0x65, 0x42, 0x11, 0x0a, 0x0f, 0x5f, 0x72, 0x65, 0x61,
+	0x63, 0x74, 0x69, 0x76, 0x65, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x42, 0x11, 0x0a, 0x0f, 0x5f,
+	0x61, 0x70, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x42, 0x0f,
+	0x0a, 0x0d, 0x5f, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x5f, 0x66, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x42,
+	0x11, 0x0a, 0x0f, 0x5f, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x5f, 0x66, 0x6f, 0x72, 0x77, 0x61,
+	0x72, 0x64, 0x42, 0x11, 0x0a, 0x0f, 0x5f, 0x65, 0x6e, 0x65, 0x72, 0x67, 0x79, 0x5f, 0x72, 0x65,
+	0x76, 0x65, 0x72, 0x73, 0x65, 0x32, 0x4a, 0x0a, 0x05, 0x4d, 0x65, 0x74, 0x65, 0x72, 0x12, 0x41,
+	0x0a, 0x09, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x12, 0x1a, 0x2e, 0x73, 0x68,
+	0x6d, 0x65, 0x74, 0x33, 0x34, 0x30, 0x2e, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x16, 0x2e, 0x73, 0x68, 0x6d, 0x65, 0x74, 0x33,
+	0x34, 0x30, 0x2e, 0x4d, 0x65, 0x74, 0x65, 0x72, 0x52, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x30,
+	0x01, 0x42, 0x13, 0x5a, 0x11, 0x73, 0x68, 0x6d, 0x2d, 0x65, 0x74, 0x33, 0x34, 0x30, 0x2f, 0x6d,
+	0x65, 0x74, 0x65, 0x72, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_meter_proto_rawDescOnce sync.Once
+	file_meter_proto_rawDescData = file_meter_proto_rawDesc
+)
+
+func file_meter_proto_rawDescGZIP() []byte {
+	file_meter_proto_rawDescOnce.Do(func() {
+		file_meter_proto_rawDescData = protoimpl.X.CompressGZIP(file_meter_proto_rawDescData)
+	})
+	return file_meter_proto_rawDescData
+}
+
+var file_meter_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_meter_proto_goTypes = []interface{}{
+	(*SubscribeRequest)(nil), // 0: shmet340.SubscribeRequest
+	(*MeterReading)(nil),     // 1: shmet340.MeterReading
+	(*Phase)(nil),            // 2: shmet340.Phase
+}
+var file_meter_proto_depIdxs = []int32{
+	2, // 0: shmet340.MeterReading.phases:type_name -> shmet340.Phase
+	0, // 1: shmet340.Meter.Subscribe:input_type -> shmet340.SubscribeRequest
+	1, // 2: shmet340.Meter.Subscribe:output_type -> shmet340.MeterReading
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_meter_proto_init() }
+func file_meter_proto_init() {
+	if File_meter_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_meter_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SubscribeRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_meter_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MeterReading); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_meter_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Phase); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_meter_proto_msgTypes[1].OneofWrappers = []interface{}{}
+	file_meter_proto_msgTypes[2].OneofWrappers = []interface{}{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_meter_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_meter_proto_goTypes,
+		DependencyIndexes: file_meter_proto_depIdxs,
+		MessageInfos:      file_meter_proto_msgTypes,
+	}.Build()
+	File_meter_proto = out.File
+	file_meter_proto_rawDesc = nil
+	file_meter_proto_goTypes = nil
+	file_meter_proto_depIdxs = nil
+}
@@ -0,0 +1,143 @@
+// The gRPC service shm-et340 serves on GRPC_ADDR, for dashboards and other clients which
+// want every meter update as it arrives. Generate a client from this file with protoc
+// for the language of your choice, the Go code in this directory is generated from it
+// with go generate.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: meter.proto
+
+package meterpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Meter_Subscribe_FullMethodName = "/shmet340.Meter/Subscribe"
+)
+
+// MeterClient is the client API for Meter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MeterClient interface {
+	// Subscribe sends the current values right away, then again after every meter update
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Meter_SubscribeClient, error)
+}
+
+type meterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMeterClient(cc grpc.ClientConnInterface) MeterClient {
+	return &meterClient{cc}
+}
+
+func (c *meterClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Meter_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Meter_ServiceDesc.Streams[0], Meter_Subscribe_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &meterSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Meter_SubscribeClient interface {
+	Recv() (*MeterReading, error)
+	grpc.ClientStream
+}
+
+type meterSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *meterSubscribeClient) Recv() (*MeterReading, error) {
+	m := new(MeterReading)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MeterServer is the server API for Meter service.
+// All implementations must embed UnimplementedMeterServer
+// for forward compatibility
+type MeterServer interface {
+	// Subscribe sends the current values right away, then again after every meter update
+	Subscribe(*SubscribeRequest, Meter_SubscribeServer) error
+	mustEmbedUnimplementedMeterServer()
+}
+
+// UnimplementedMeterServer must be embedded to have forward compatible implementations.
+type UnimplementedMeterServer struct {
+}
+
+func (UnimplementedMeterServer) Subscribe(*SubscribeRequest, Meter_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedMeterServer) mustEmbedUnimplementedMeterServer() {}
+
+// UnsafeMeterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MeterServer will
+// result in compilation errors.
+type UnsafeMeterServer interface {
+	mustEmbedUnimplementedMeterServer()
+}
+
+func RegisterMeterServer(s grpc.ServiceRegistrar, srv MeterServer) {
+	s.RegisterService(&Meter_ServiceDesc, srv)
+}
+
+func _Meter_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MeterServer).Subscribe(m, &meterSubscribeServer{stream})
+}
+
+type Meter_SubscribeServer interface {
+	Send(*MeterReading) error
+	grpc.ServerStream
+}
+
+type meterSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *meterSubscribeServer) Send(m *MeterReading) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Meter_ServiceDesc is the grpc.ServiceDesc for Meter service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Meter_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "shmet340.Meter",
+	HandlerType: (*MeterServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Meter_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "meter.proto",
+}
@@ -0,0 +1,248 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// meterEntry is one meter to follow when several are listed in METERS
+type meterEntry struct {
+	serial   uint32
+	instance int
+}
+
+// parseMeters reads METERS, a comma separated list of serial:deviceinstance pairs
+func parseMeters(s string) ([]meterEntry, error) {
+	var meters []meterEntry
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected serial:deviceinstance, got %q", item)
+		}
+		serial, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad serial in %q: %v", item, err)
+		}
+		instance, err := strconv.Atoi(parts[1])
+		if err != nil || instance < 0 || instance > 255 {
+			return nil, fmt.Errorf("bad device instance in %q", item)
+		}
+		meters = append(meters, meterEntry{uint32(serial), instance})
+	}
+	return meters, nil
+}
+
+// runMeters follows several meters at once by running a copy of this program for each,
+// filtering on its serial and announcing itself with its own device instance. Every
+// copy has its own dbus service, and so its own connection and values. Copies which
+// fail are restarted, ones which exit cleanly are not; SIGINT and SIGTERM stop all of
+// them. Under systemd, what the
+// copies notify is relayed by notifyRelay.
+func runMeters(meters []meterEntry) {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal("Could not find my own executable: ", err)
+	}
+	relay := newNotifyRelay(meters)
+	defer relay.close()
+
+	var (
+		mu       sync.Mutex
+		procs    = map[uint32]*os.Process{}
+		stopping bool
+		wg       sync.WaitGroup
+	)
+
+	for _, m := range meters {
+		m := m
+		// exec uses the last of duplicate variables, so these win over the inherited ones.
+		// An empty METERS stops the copy from following all meters again: it reads the
+		// same config file, which can't override what is set in the environment.
+		env := append(os.Environ(),
+			"METERS=",
+			fmt.Sprint("SERIAL=", m.serial),
+			fmt.Sprint("DEVICE_INSTANCE=", m.instance),
+		)
+		if os.Getenv("CUSTOM_NAME") == "" {
+			env = append(env, fmt.Sprintf("CUSTOM_NAME=%s %d", cfg.CustomName, m.serial))
+		}
+		if path := relay.socket(m.serial); path != "" {
+			env = append(env, "NOTIFY_SOCKET="+path)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				cmd := exec.Command(self, os.Args[1:]...)
+				cmd.Env = env
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+
+				mu.Lock()
+				if stopping {
+					mu.Unlock()
+					return
+				}
+				err := cmd.Start()
+				if err == nil {
+					procs[m.serial] = cmd.Process
+				}
+				mu.Unlock()
+
+				if err == nil {
+					log.Infof("Following meter %d as device instance %d (pid %d)", m.serial, m.instance, cmd.Process.Pid)
+					err = cmd.Wait()
+				}
+
+				mu.Lock()
+				delete(procs, m.serial)
+				done := stopping
+				mu.Unlock()
+				if done {
+					return
+				}
+				if err == nil {
+					// Finished what it was asked to, e.g. with -once or -packets
+					log.Infof("Process for meter %d finished", m.serial)
+					return
+				}
+				log.Warnf("Process for meter %d exited (%v), restarting in 5s", m.serial, err)
+				time.Sleep(5 * time.Second)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for s := range sig {
+			mu.Lock()
+			if s != syscall.SIGHUP {
+				stopping = true
+			}
+			for _, p := range procs {
+				p.Signal(s)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	wg.Wait()
+}
+
+// notifyRelay passes on what the copies of runMeters tell systemd. With NotifyAccess=main
+// systemd only listens to the process it started, so each copy gets a notify socket of
+// the parent's instead. READY=1 is sent once every copy is ready, and WATCHDOG=1 once
+// every copy decoded an update since the last one, so one stuck meter still trips
+// WatchdogSec=.
+type notifyRelay struct {
+	mu     sync.Mutex
+	conns  map[uint32]*net.UnixConn
+	ready  map[uint32]bool
+	pinged map[uint32]bool
+	sent   bool
+}
+
+// newNotifyRelay opens a notify socket for each meter. Without NOTIFY_SOCKET there is
+// nobody to relay to, and the copies notify no one either.
+func newNotifyRelay(meters []meterEntry) *notifyRelay {
+	r := &notifyRelay{
+		conns:  map[uint32]*net.UnixConn{},
+		ready:  map[uint32]bool{},
+		pinged: map[uint32]bool{},
+	}
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return r
+	}
+	for _, m := range meters {
+		path := filepath.Join(os.TempDir(), fmt.Sprintf("shm-et340-%d-%d.notify", os.Getpid(), m.serial))
+		os.Remove(path)
+		c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			log.Warn("Could not open a notify socket for meter ", m.serial, ": ", err)
+			continue
+		}
+		r.conns[m.serial] = c
+		go r.read(m.serial, c)
+	}
+	return r
+}
+
+// socket is the path the copy for serial notifies on, empty if there is none
+func (r *notifyRelay) socket(serial uint32) string {
+	if c, ok := r.conns[serial]; ok {
+		return c.LocalAddr().String()
+	}
+	return ""
+}
+
+func (r *notifyRelay) read(serial uint32, c *net.UnixConn) {
+	b := make([]byte, 4096)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return
+		}
+		for _, state := range strings.Split(string(b[:n]), "\n") {
+			r.notified(serial, state)
+		}
+	}
+}
+
+// notified records what the copy for serial sent and tells systemd once all agree
+func (r *notifyRelay) notified(serial uint32, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch state {
+	case "READY=1":
+		r.ready[serial] = true
+		if !r.sent && len(r.ready) == len(r.conns) {
+			r.sent = true
+			sdNotify("READY=1")
+		}
+	case "WATCHDOG=1":
+		r.pinged[serial] = true
+		if len(r.pinged) == len(r.conns) {
+			r.pinged = map[uint32]bool{}
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+func (r *notifyRelay) close() {
+	for _, c := range r.conns {
+		c.Close()
+		os.Remove(c.LocalAddr().String())
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain stands in for the copies runMeters starts of the test binary: with
+// METERS_TEST_EXIT set, it exits right away instead of running the tests
+func TestMain(m *testing.M) {
+	if os.Getenv("METERS_TEST_EXIT") != "" {
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRunMetersFinished(t *testing.T) {
+	t.Setenv("METERS_TEST_EXIT", "1")
+	resetState(t)
+
+	// Copies which finished, e.g. with -once, aren't started again
+	done := make(chan struct{})
+	go func() {
+		runMeters([]meterEntry{{1900000001, 30}, {1900000002, 31}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(4 * time.Second):
+		t.Fatal("runMeters still running after its copies exited cleanly")
+	}
+}
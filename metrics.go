@@ -0,0 +1,100 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A prometheus metric and the dbus paths it is read from. Paths are formatted with
+// the phase name for per-phase metrics.
+type metric struct {
+	name     string
+	kind     string // gauge or counter
+	help     string
+	total    string
+	perPhase string
+	// The config inverting the sign of the metric, nil if it has no sign
+	inverted func() bool
+}
+
+var metrics = []metric{
+	{"shm_et340_power_watts", "gauge", "Active power", "/Ac/Power", "/Ac/%s/Power", func() bool { return cfg.InvertPower }},
+	{"shm_et340_voltage_volts", "gauge", "Voltage", "", "/Ac/%s/Voltage", nil},
+	{"shm_et340_current_amperes", "gauge", "Current", "", "/Ac/%s/Current", func() bool { return cfg.InvertCurrent }},
+	{"shm_et340_energy_forward_kwh_total", "counter", "Energy bought from the grid", "/Ac/Energy/Forward", "/Ac/%s/Energy/Forward", nil},
+	{"shm_et340_energy_reverse_kwh_total", "counter", "Energy sold to the grid", "/Ac/Energy/Reverse", "/Ac/%s/Energy/Reverse", nil},
+}
+
+// helpText describes the metric, with the sign it is published with
+func (m metric) helpText() string {
+	switch {
+	case m.inverted == nil:
+		return m.help
+	case m.inverted():
+		return m.help + ", negative when buying"
+	default:
+		return m.help + ", positive when buying"
+	}
+}
+
+// serveMetrics exposes the current meter values in the prometheus text format on
+// addr. It only returns if the listener fails.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	log.Info("Serving prometheus metrics on ", addr, "/metrics")
+	log.Error("Metrics server stopped: ", http.ListenAndServe(addr, mux))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	// A snapshot, so all values belong to the same datagram
+	values := snapshotValues()
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.helpText(), m.name, m.kind)
+		if v, ok := values[m.total]; ok {
+			fmt.Fprintf(&buf, "%s %g\n", m.name, v)
+		}
+		for _, phase := range []string{"L1", "L2", "L3"} {
+			path := fmt.Sprintf(m.perPhase, phase)
+			if v, ok := values[path]; ok {
+				fmt.Fprintf(&buf, "%s{phase=%q} %g\n", m.name, phase, v)
+			}
+		}
+	}
+
+	s := stats.snapshot()
+	fmt.Fprintf(&buf, "# HELP shm_et340_datagrams_total Datagrams received, by what became of them\n# TYPE shm_et340_datagrams_total counter\n")
+	for _, c := range []struct {
+		result string
+		n      uint64
+	}{{"filtered", s.filtered}, {"short", s.short}, {"decoded", s.decoded}} {
+		fmt.Fprintf(&buf, "shm_et340_datagrams_total{result=%q} %d\n", c.result, c.n)
+	}
+	fmt.Fprintf(&buf, "# HELP shm_et340_energy_rejected_total Energy counter values left out as implausible\n# TYPE shm_et340_energy_rejected_total counter\n")
+	fmt.Fprintf(&buf, "shm_et340_energy_rejected_total %d\n", s.rejected)
+	decodeLatency.writeHistogram(&buf, "shm_et340_decode_seconds", "Time to decode a meter update")
+	publishLatency.writeHistogram(&buf, "shm_et340_publish_seconds", "Time to publish a meter update, dbus signals included")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,50 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetricsSign(t *testing.T) {
+	for _, invert := range []bool{false, true} {
+		t.Run("INVERT_POWER="+strconv.FormatBool(invert), func(t *testing.T) {
+			t.Setenv("INVERT_POWER", strconv.FormatBool(invert))
+			resetState(t)
+			setupValues(roles[cfg.Role])
+			b := loadFixture(t, "energy-meter.hex")
+			msgHandler(nil, len(b), b)
+
+			w := httptest.NewRecorder()
+			metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+			body := w.Body.String()
+
+			help, value := "positive when buying", "shm_et340_power_watts 2345.6"
+			if invert {
+				help, value = "negative when buying", "shm_et340_power_watts -2345.6"
+			}
+			if !strings.Contains(body, "# HELP shm_et340_power_watts Active power, "+help+"\n") {
+				t.Errorf("power help doesn't say %q:\n%s", help, body)
+			}
+			if !strings.Contains(body, value) {
+				t.Errorf("no %q in\n%s", value, body)
+			}
+		})
+	}
+}
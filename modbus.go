@@ -0,0 +1,205 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SMA devices publish the values of the meter connected to them in these 32 bit
+// registers, all unsigned with 0xffffffff meaning "not available"
+const (
+	regSerial       = 30057 // serial number of the device
+	regEnergyBought = 30581 // Wh
+	regEnergySold   = 30583 // Wh
+	regPowerBought  = 30865 // W
+	regPowerSold    = 30867 // W
+	regVoltage      = 31253 // L1 to L3 follow, 0.01 V
+	regPhaseSold    = 31259 // L1 to L3 follow, W
+	regPhaseBought  = 31265 // L1 to L3 follow, W
+	regFrequency    = 31447 // 0.01 Hz
+)
+
+// modbusBlocks are the register ranges read with each poll, as start and number of
+// 32 bit values
+var modbusBlocks = [][2]uint16{
+	{regSerial, 1},
+	{regEnergyBought, 2},
+	{regPowerBought, 2},
+	{regVoltage, 9},
+	{regFrequency, 1},
+}
+
+// runModbus polls the meter values from an SMA device, or with METER_TYPE=em24 from a
+// Carlo Gavazzi EM24, over Modbus TCP every interval, as an alternative to the meter's
+// multicast. It returns nil once ctx is done.
+func runModbus(ctx context.Context) error {
+	log.Info("Polling meter values from ", cfg.ModbusAddr, " every ", cfg.ModbusInterval)
+	poll := pollModbus
+	if cfg.MeterType == "em24" {
+		poll = pollEM24
+	}
+	var c net.Conn
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	tick := time.NewTicker(cfg.ModbusInterval)
+	defer tick.Stop()
+	for {
+		if c == nil {
+			var err error
+			var d net.Dialer
+			if c, err = d.DialContext(ctx, "tcp", cfg.ModbusAddr); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Warn("Could not connect to ", cfg.ModbusAddr, ": ", err)
+				c = nil
+			}
+		}
+		if c != nil {
+			if err := poll(c); err != nil {
+				log.Warn("Modbus poll failed: ", err)
+				c.Close()
+				c = nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+// pollModbus reads all registers once and publishes them like a meter update
+func pollModbus(c net.Conn) error {
+	count(&stats.received)
+	regs := map[uint16]uint32{}
+	for _, block := range modbusBlocks {
+		values, err := readRegisters(c, block[0], block[1])
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			regs[block[0]+uint16(2*i)] = v
+		}
+	}
+
+	// 0xffffffff is what SMA sends for values it doesn't have
+	reg := func(addr uint16) uint32 {
+		if v := regs[addr]; v != 0xffffffff {
+			return v
+		}
+		return 0
+	}
+
+	markPacket(regs[regSerial], 0)
+	r := meterReading{
+		power:     float32(reg(regPowerBought)) - float32(reg(regPowerSold)),
+		forward:   float64(reg(regEnergyBought)) / 1000,
+		reverse:   float64(reg(regEnergySold)) / 1000,
+		energy:    true,
+		frequency: float64(reg(regFrequency)) / 100,
+		phases:    make([]singlePhase, cfg.Phases),
+	}
+	for i := range r.phases {
+		L := &r.phases[i]
+		L.voltage = float32(reg(regVoltage+uint16(2*i))) / 100
+		L.power = float32(reg(regPhaseBought+uint16(2*i))) - float32(reg(regPhaseSold+uint16(2*i)))
+		// No current over Modbus, it's estimated from power and voltage
+		L.setCurrent(0)
+	}
+
+	publishReading(r)
+	return nil
+}
+
+// modbusTransaction numbers the requests, so answers can be matched to them
+var modbusTransaction uint16
+
+// readRegisters reads n 32 bit values starting at register addr with function 0x03
+func readRegisters(c net.Conn, addr uint16, n uint16) ([]uint32, error) {
+	words, err := readWords(c, addr, 2*n)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]uint32, n)
+	for i := range values {
+		values[i] = uint32(words[2*i])<<16 | uint32(words[2*i+1])
+	}
+	return values, nil
+}
+
+// readWords reads n 16 bit registers starting at addr with function 0x03
+func readWords(c net.Conn, addr uint16, n uint16) ([]uint16, error) {
+	modbusTransaction++
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:2], modbusTransaction)
+	binary.BigEndian.PutUint16(req[2:4], 0) // Modbus
+	binary.BigEndian.PutUint16(req[4:6], 6) // bytes following
+	req[6] = cfg.ModbusUnit
+	req[7] = 0x03
+	binary.BigEndian.PutUint16(req[8:10], addr)
+	binary.BigEndian.PutUint16(req[10:12], n)
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	var hdr [7]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(hdr[4:6]))
+	if length < 2 || length > 256 {
+		return nil, fmt.Errorf("implausible answer length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(c, pdu); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(hdr[0:2]) != modbusTransaction {
+		return nil, fmt.Errorf("answer to transaction %d instead of %d", binary.BigEndian.Uint16(hdr[0:2]), modbusTransaction)
+	}
+	if len(pdu) < 2 {
+		return nil, fmt.Errorf("unexpected answer reading register %d", addr)
+	}
+	if pdu[0] == 0x83 {
+		return nil, fmt.Errorf("reading register %d failed with exception %d", addr, pdu[1])
+	}
+	if pdu[0] != 0x03 || int(pdu[1]) != 2*int(n) || len(pdu) < 2+2*int(n) {
+		return nil, fmt.Errorf("unexpected answer reading register %d", addr)
+	}
+
+	words := make([]uint16, n)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint16(pdu[2+2*i:])
+	}
+	return words, nil
+}
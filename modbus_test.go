@@ -0,0 +1,67 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRunModbusCancel(t *testing.T) {
+	resetState(t)
+	// A port nobody listens on, runModbus keeps trying to connect until cancelled
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ModbusAddr = l.Addr().String()
+	l.Close()
+
+	started := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(started)
+	}()
+	returnsOnCancel(t, started, runModbus)
+}
+
+func TestEM24PhaseReverse(t *testing.T) {
+	t.Setenv("METER_TYPE", "em24")
+	t.Setenv("MODBUS_ADDR", "127.0.0.1:502")
+	resetState(t)
+	setupValues(roles[cfg.Role])
+
+	// The EM24 counts the energy sold only in total
+	phases := make([]singlePhase, 3)
+	for i := range phases {
+		phases[i] = singlePhase{voltage: 230, power: 100, forward: 10 * float64(i+1)}
+	}
+	publishReading(meterReading{energy: true, forward: 60, reverse: 5, phases: phases})
+
+	if got := publishedValue(t, "/Ac/Energy/Reverse"); got != 5 {
+		t.Errorf("/Ac/Energy/Reverse %v, want 5", got)
+	}
+	if got := publishedValue(t, "/Ac/L2/Energy/Forward"); got != 20 {
+		t.Errorf("/Ac/L2/Energy/Forward %v, want 20", got)
+	}
+	valuesMu.RLock()
+	defer valuesMu.RUnlock()
+	for _, phase := range phaseNames {
+		if v, ok := victronValues[0][objectpath("/Ac/"+phase+"/Energy/Reverse")]; ok {
+			t.Errorf("/Ac/%s/Energy/Reverse published as %v", phase, v)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "fmt"
+
+// meterModel describes where a meter model puts its values in an update
+type meterModel struct {
+	name          string
+	totals        []obisField // offsets from the start of the datagram
+	phaseOffset   int         // start of the L1 block, L2 and L3 follow directly
+	phaseLen      int         // length of one phase block
+	phase         []obisField // offsets from the start of a phase block
+	versionOffset int         // the software version entry (0x90000000) after the phase blocks
+	voltageScale  int         // index into voltageScales, -1 to detect it from the first voltages
+	energy        bool        // sends energy counters, see sendsEnergy
+}
+
+// speedwire is the layout used by all meters seen so far
+var speedwire = meterModel{"", speedwireTotals, phaseOffset, phaseLen, speedwirePhase, phaseOffset + 3*phaseLen, -1, true}
+
+// models is keyed by the SUSy ID in the header, the 2 bytes at 18 in front of the serial,
+// which tells the kind of device sending. A meter which sends its values elsewhere only
+// needs its own entry here.
+var models = map[uint16]meterModel{
+	270: named("Energy Meter", speedwire, -1),
+	349: named("Energy Meter 2.0", speedwire, 0),
+	372: named("Sunny Home Manager 2.0", speedwire, 0),
+	501: named("Sunny Home Manager 2.0", speedwire, 0),
+}
+
+// named returns layout under a different name, with voltages in the given unit
+func named(name string, layout meterModel, voltageScale int) meterModel {
+	layout.name = name
+	layout.voltageScale = voltageScale
+	return layout
+}
+
+// describeModel names the device with the given SUSy ID for the log and the status, e.g.
+// "Energy Meter 2.0 (SUSy ID 349)". Meters read over Modbus have none and pass 0.
+func describeModel(susyID uint16) string {
+	if susyID == 0 {
+		return "meter read over Modbus"
+	}
+	return fmt.Sprintf("%s (SUSy ID %d)", modelFor(susyID).name, susyID)
+}
+
+// modelFor looks up the layout of the meter with the given SUSy ID. Unknown meters
+// are tried with the common layout.
+func modelFor(susyID uint16) meterModel {
+	if m, ok := models[susyID]; ok {
+		return m
+	}
+	return named("unknown meter", speedwire, -1)
+}
@@ -0,0 +1,240 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// A sensor published to MQTT, with what Home Assistant needs to know about it
+type mqttSensor struct {
+	key         string // in the JSON state and the unique id
+	name        string
+	path        string // dbus path the value is read from
+	unit        string
+	deviceClass string
+	stateClass  string
+	phase       int // 1 to 3 for the per-phase sensors, left out with fewer PHASES
+}
+
+// mqttSensors are sent with every update, mqttEnergySensors at most every MQTT_ENERGY_INTERVAL
+var (
+	mqttSensors = []mqttSensor{
+		{"power", "Power", "/Ac/Power", "W", "power", "measurement", 0},
+		{"current", "Current", "/Ac/Current", "A", "current", "measurement", 0},
+		{"voltage", "Voltage", "/Ac/Voltage", "V", "voltage", "measurement", 0},
+		{"frequency", "Frequency", "/Ac/Frequency", "Hz", "frequency", "measurement", 0},
+	}
+	mqttEnergySensors = []mqttSensor{
+		{"energy_forward", "Energy bought", "/Ac/Energy/Forward", "kWh", "energy", "total_increasing", 0},
+		{"energy_reverse", "Energy sold", "/Ac/Energy/Reverse", "kWh", "energy", "total_increasing", 0},
+	}
+)
+
+func init() {
+	for i, phase := range phaseNames {
+		mqttSensors = append(mqttSensors,
+			mqttSensor{"power_" + phase, phase + " power", "/Ac/" + phase + "/Power", "W", "power", "measurement", i + 1},
+			mqttSensor{"current_" + phase, phase + " current", "/Ac/" + phase + "/Current", "A", "current", "measurement", i + 1},
+			mqttSensor{"voltage_" + phase, phase + " voltage", "/Ac/" + phase + "/Voltage", "V", "voltage", "measurement", i + 1},
+		)
+	}
+}
+
+// mqttUpdates wakes up runMQTT after a meter update. msgHandler never waits for it, if
+// the broker is slow, updates in between are skipped.
+var mqttUpdates = make(chan struct{}, 1)
+
+// notifyMQTT tells the MQTT publisher there are new values, without ever blocking
+func notifyMQTT() {
+	select {
+	case mqttUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// runMQTT publishes the meter values to the broker for as long as the program runs. The
+// client connects again on its own whenever the connection is lost.
+func runMQTT() {
+	connected := make(chan struct{}, 1)
+	client := newMQTTClient(connected)
+
+	// Only the first connection is made here, the client takes care of reconnecting
+	delay := time.Second
+	for {
+		t := client.Connect()
+		t.Wait()
+		if t.Error() == nil {
+			break
+		}
+		log.Warn("Could not connect to MQTT broker ", cfg.MQTTBroker, ": ", t.Error())
+		time.Sleep(delay)
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+	publishMQTT(client, connected, nil)
+}
+
+// newMQTTClient sets up a client for MQTT_BROKER, with a will marking the meter offline.
+// connected is signalled every time the connection is made.
+func newMQTTClient(connected chan<- struct{}) mqtt.Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(mqttBrokerURL(cfg.MQTTBroker)).
+		SetClientID(cfg.MQTTClientID).
+		SetProtocolVersion(4). // 3.1.1, without falling back to 3.1 when refused
+		SetUsername(cfg.MQTTUser).
+		SetPassword(cfg.MQTTPassword).
+		SetKeepAlive(mqttKeepAlive).
+		SetConnectTimeout(10*time.Second).
+		SetWriteTimeout(10*time.Second).
+		SetMaxReconnectInterval(30*time.Second).
+		SetWill(cfg.MQTTTopic+"/status", "offline", 0, true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			log.Info("Connected to MQTT broker ", cfg.MQTTBroker)
+			mqttPublish(c, cfg.MQTTTopic+"/status", []byte("online"), true)
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warn("MQTT connection to ", cfg.MQTTBroker, " lost: ", err)
+		})
+	return mqtt.NewClient(opts)
+}
+
+// publishMQTT sends the values after every meter update until stop is closed. Updates
+// while the connection is down are skipped.
+func publishMQTT(client mqtt.Client, connected, stop <-chan struct{}) {
+	var discoverySent bool
+	var lastEnergy time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-connected:
+			// The broker may have lost the retained announcements meanwhile
+			discoverySent = false
+		case <-mqttUpdates:
+			if !client.IsConnectionOpen() {
+				continue
+			}
+			valuesMu.RLock()
+			id := meterID
+			valuesMu.RUnlock()
+
+			if !discoverySent && cfg.MQTTDiscovery != "" {
+				mqttDiscovery(client, id)
+				discoverySent = true
+			}
+			mqttPublish(client, cfg.MQTTTopic+"/state", mqttState(mqttSensors), false)
+			if cfg.EnergyCounters && time.Since(lastEnergy) >= cfg.MQTTEnergyInterval {
+				mqttPublish(client, cfg.MQTTTopic+"/energy", mqttState(mqttEnergySensors), false)
+				lastEnergy = time.Now()
+			}
+		}
+	}
+}
+
+// How often the broker expects to hear from us
+const mqttKeepAlive = 60 * time.Second
+
+// mqttBrokerURL turns MQTT_BROKER into the URL the client expects. A plain host:port is
+// a TCP connection, ssl://, ws:// and wss:// are passed on as they are.
+func mqttBrokerURL(broker string) string {
+	if strings.Contains(broker, "://") {
+		return broker
+	}
+	return "tcp://" + broker
+}
+
+// mqttPublish sends payload to topic with QoS 0. A failure is only logged, the next
+// update is sent anyway.
+func mqttPublish(c mqtt.Client, topic string, payload []byte, retain bool) {
+	t := c.Publish(topic, 0, retain, payload)
+	if !t.WaitTimeout(10 * time.Second) {
+		log.Warn("Publishing ", topic, " to MQTT timed out")
+		return
+	}
+	if err := t.Error(); err != nil {
+		log.Warn("Could not publish ", topic, " to MQTT: ", err)
+	}
+}
+
+// mqttState is the JSON object with the current value of every sensor
+func mqttState(sensors []mqttSensor) []byte {
+	state := map[string]interface{}{}
+	values := snapshotValues()
+	for _, s := range sensors {
+		if v, ok := values[s.path]; ok {
+			state[s.key] = v
+		}
+	}
+	data, _ := json.Marshal(state)
+	return data
+}
+
+// mqttDiscovery announces all sensors to Home Assistant, so they show up on their own
+func mqttDiscovery(c mqtt.Client, id string) {
+	node := fmt.Sprintf("shm_et340_%s", id)
+	device := map[string]interface{}{
+		"identifiers":  []string{node},
+		"name":         customName(),
+		"manufacturer": "SMA",
+		"model":        cfg.ProductName,
+		"sw_version":   version,
+	}
+
+	announce := func(s mqttSensor, stateTopic string) {
+		config := map[string]interface{}{
+			"name":                s.name,
+			"unique_id":           node + "_" + s.key,
+			"state_topic":         stateTopic,
+			"value_template":      "{{ value_json." + s.key + " }}",
+			"unit_of_measurement": s.unit,
+			"device_class":        s.deviceClass,
+			"state_class":         s.stateClass,
+			"availability_topic":  cfg.MQTTTopic + "/status",
+			"device":              device,
+		}
+		data, _ := json.Marshal(config)
+		mqttPublish(c, fmt.Sprintf("%s/sensor/%s/%s/config", cfg.MQTTDiscovery, node, s.key), data, true)
+	}
+
+	for _, s := range mqttSensors {
+		if s.phase > cfg.Phases || (s.phase > 0 && !cfg.PublishPhases) {
+			continue
+		}
+		announce(s, cfg.MQTTTopic+"/state")
+	}
+	for _, s := range mqttEnergySensors {
+		if !cfg.EnergyCounters {
+			break
+		}
+		if !roles[cfg.Role].has(s.path) {
+			continue
+		}
+		announce(s, cfg.MQTTTopic+"/energy")
+	}
+	log.Info("Announced the meter to Home Assistant as ", node)
+}
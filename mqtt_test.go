@@ -0,0 +1,151 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeBroker accepts one client, answers CONNECT with returnCode and passes on the
+// CONNECT and every PUBLISH it receives
+func fakeBroker(t *testing.T, returnCode byte) (string, <-chan *packets.ConnectPacket, <-chan *packets.PublishPacket) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	connects := make(chan *packets.ConnectPacket, 1)
+	publishes := make(chan *packets.PublishPacket, 100)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		p, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		connects <- p.(*packets.ConnectPacket)
+		ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ack.ReturnCode = returnCode
+		if err := ack.Write(c); err != nil || returnCode != packets.Accepted {
+			return
+		}
+		for {
+			p, err := packets.ReadPacket(c)
+			if err != nil {
+				return
+			}
+			switch p := p.(type) {
+			case *packets.PublishPacket:
+				publishes <- p
+			case *packets.PingreqPacket:
+				packets.NewControlPacket(packets.Pingresp).Write(c)
+			}
+		}
+	}()
+	return l.Addr().String(), connects, publishes
+}
+
+func TestMQTTRefused(t *testing.T) {
+	addr, _, _ := fakeBroker(t, packets.ErrRefusedNotAuthorised)
+	t.Setenv("MQTT_BROKER", addr)
+	resetState(t)
+
+	client := newMQTTClient(make(chan struct{}, 1))
+	tok := client.Connect()
+	if !tok.WaitTimeout(5 * time.Second) {
+		t.Fatal("no answer to CONNECT")
+	}
+	if tok.Error() == nil {
+		t.Error("connection refused by the broker taken as connected")
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	addr, connects, publishes := fakeBroker(t, packets.Accepted)
+	t.Setenv("MQTT_BROKER", addr)
+	t.Setenv("MQTT_USER", "meter")
+	t.Setenv("MQTT_PASSWORD", "secret")
+	resetState(t)
+	setupValues(roles[cfg.Role])
+	b := loadFixture(t, "energy-meter.hex")
+	msgHandler(nil, len(b), b)
+
+	connected := make(chan struct{}, 1)
+	client := newMQTTClient(connected)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatal("could not connect: ", tok.Error())
+	}
+	defer client.Disconnect(0)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		publishMQTT(client, connected, stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	c := <-connects
+	if c.ClientIdentifier != cfg.MQTTClientID || c.Username != "meter" || string(c.Password) != "secret" {
+		t.Errorf("CONNECT as %q, user %q, password %q", c.ClientIdentifier, c.Username, c.Password)
+	}
+	if !c.WillFlag || !c.WillRetain || c.WillTopic != cfg.MQTTTopic+"/status" || string(c.WillMessage) != "offline" {
+		t.Errorf("will %v %q %q retained %v, want a retained offline on %s/status", c.WillFlag, c.WillTopic, c.WillMessage, c.WillRetain, cfg.MQTTTopic)
+	}
+
+	received := map[string]*packets.PublishPacket{}
+	timeout := time.After(5 * time.Second)
+	for received[cfg.MQTTTopic+"/state"] == nil {
+		select {
+		case p := <-publishes:
+			received[p.TopicName] = p
+		case <-timeout:
+			t.Fatalf("no state published, only %d topics", len(received))
+		}
+	}
+
+	if p := received[cfg.MQTTTopic+"/status"]; p == nil || string(p.Payload) != "online" || !p.Retain {
+		t.Errorf("no retained online status published")
+	}
+	var announced bool
+	for topic, p := range received {
+		if strings.HasPrefix(topic, cfg.MQTTDiscovery+"/sensor/") && strings.HasSuffix(topic, "/power/config") {
+			announced = p.Retain
+		}
+	}
+	if !announced {
+		t.Error("power sensor not announced to Home Assistant")
+	}
+	var state map[string]float64
+	if err := json.Unmarshal(received[cfg.MQTTTopic+"/state"].Payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if !near(state["power"], 2345.6) {
+		t.Errorf("power %v in the state, want 2345.6", state["power"])
+	}
+}
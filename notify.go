@@ -0,0 +1,56 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	notifyOnce sync.Once
+	notifyConn *net.UnixConn
+)
+
+// sdNotify tells systemd about our state, e.g. "READY=1" or "WATCHDOG=1". Without
+// NOTIFY_SOCKET we're not started by systemd (or not as Type=notify) and nothing is sent.
+func sdNotify(state string) {
+	notifyOnce.Do(func() {
+		path := os.Getenv("NOTIFY_SOCKET")
+		if path == "" {
+			return
+		}
+		if path[0] == '@' {
+			// Abstract socket
+			path = "\x00" + path[1:]
+		}
+		c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			log.Warn("Could not connect to NOTIFY_SOCKET: ", err)
+			return
+		}
+		notifyConn = c
+	})
+	if notifyConn == nil {
+		return
+	}
+	if _, err := notifyConn.Write([]byte(state)); err != nil {
+		log.Debug("Could not notify systemd: ", err)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// obisField describes one value in a meter update. The meter sends most values as a
+// pair, e.g. power bought and power sold, which end up as one signed value of the
+// quantity both halves share.
+type obisField struct {
+	obis     string                         // OBIS code, for reference only
+	offset   int                            // of the value, from the start of the datagram or phase block
+	size     int                            // 4 or 8 bytes
+	sell     bool                           // the selling half of a pair, subtracted from the other
+	quantity quantity                       // what is measured, published below /Ac/ or /Ac/Lx/
+	scale    func(buy, sell uint64) float64 // converts the meter's units to the published ones
+}
+
+// quantity is what a field measures. Each has a fixed slot in fieldValues, so decoding
+// an update doesn't allocate.
+type quantity int
+
+const (
+	qPower         quantity = iota // Power
+	qEnergyForward                 // Energy/Forward
+	qEnergyReverse                 // Energy/Reverse
+	qReactivePower                 // ReactivePower
+	qApparentPower                 // ApparentPower
+	qFrequency                     // Frequency
+	qCurrent                       // Current
+	qVoltage                       // Voltage
+	numQuantities
+)
+
+// fieldValues are the scaled values decodeFields read, by quantity
+type fieldValues struct {
+	value [numQuantities]float64
+	sent  [numQuantities]bool // a field of the quantity was in the fields decoded
+}
+
+// get returns the value of q and whether it was decoded
+func (v *fieldValues) get(q quantity) (float64, bool) {
+	return v.value[q], v.sent[q]
+}
+
+// isEnergy tells whether q is one of the energy counters
+func (q quantity) isEnergy() bool {
+	return q == qEnergyForward || q == qEnergyReverse
+}
+
+// The units the meter sends its values in
+func deci(buy, sell uint64) float64        { return float64((float32(buy) - float32(sell)) / 10) }   // 0.1 W, var and VA
+func deciEach(buy, sell uint64) float64    { return float64(float32(buy)/10 - float32(sell)/10) }    // same, rounded as the phases always were
+func milli(buy, sell uint64) float64       { return float64((float32(buy) - float32(sell)) / 1000) } // mA and mV
+func milliHertz(buy, sell uint64) float64  { return (float64(buy) - float64(sell)) / 1000.0 }
+func wattSeconds(buy, sell uint64) float64 { return (float64(buy) - float64(sell)) / 3600.0 / 1000.0 } // to kWh
+
+// speedwireTotals are the values for all phases together, offsets from the start of
+// the datagram. Every pair comes out as buying minus selling, so power is positive while
+// importing from the grid and negative while exporting, as Victron's grid meters count
+// it and the Home Manager shows it.
+var speedwireTotals = []obisField{
+	{"1:1.4.0", 32, 4, false, qPower, deci},
+	{"1:2.4.0", 52, 4, true, qPower, deci},
+	{"1:1.8.0", 40, 8, false, qEnergyForward, wattSeconds},
+	{"1:2.8.0", 60, 8, false, qEnergyReverse, wattSeconds},
+	{"1:3.4.0", 72, 4, false, qReactivePower, deci},
+	{"1:4.4.0", 92, 4, true, qReactivePower, deci},
+	{"1:9.4.0", 112, 4, false, qApparentPower, deci},
+	{"1:10.4.0", 132, 4, true, qApparentPower, deci},
+	// Older meters (SHM1.0) don't measure it and send 0
+	{"1:14.4.0", 160, 4, false, qFrequency, milliHertz},
+}
+
+// None of the meters seen so far send a total current. A model which does (OBIS 1:11.4.0)
+// should add it to its totals as qCurrent, which CURRENT_TOTAL_MODE=meter
+// then publishes instead of the sum of the phases.
+
+// speedwirePhase are the values of one phase, offsets from the start of its block.
+// The OBIS codes are those of L1, L2 and L3 add another 20 and 40. Every entry is the
+// 4 byte OBIS code followed by its value, so e.g. 1:21.8.0 starts at 8 and its value at 12.
+//
+// The per-phase energy counters don't add up to the totals: the totals count the sum of
+// all phases (a house buying on L1 what it sells on L2 buys nothing), the phases count
+// each phase on its own.
+var speedwirePhase = []obisField{
+	{"1:21.4.0", 4, 4, false, qPower, deciEach},
+	{"1:22.4.0", 24, 4, true, qPower, deciEach},
+	{"1:21.8.0", 12, 8, false, qEnergyForward, wattSeconds},
+	{"1:22.8.0", 32, 8, false, qEnergyReverse, wattSeconds},
+	{"1:23.4.0", 44, 4, false, qReactivePower, deciEach},
+	{"1:24.4.0", 64, 4, true, qReactivePower, deciEach},
+	{"1:29.4.0", 84, 4, false, qApparentPower, deciEach},
+	{"1:30.4.0", 104, 4, true, qApparentPower, deciEach},
+	// The meter only reports the magnitude of the current
+	{"1:31.4.0", 124, 4, false, qCurrent, milli},
+	{"1:32.4.0", 132, 4, false, qVoltage, milli},
+}
+
+// channel is the channel of the OBIS code, e.g. 21 for "1:21.4.0"
+func (f obisField) channel() int {
+	code := f.obis[strings.IndexByte(f.obis, ':')+1:]
+	channel, _ := strconv.Atoi(code[:strings.IndexByte(code, '.')])
+	return channel
+}
+
+// sendsEnergy tells whether the update in b carries energy counters. Some sources, e.g.
+// inverters passing on the meter's power, only send the power and have something else
+// where the counters would be. The OBIS code in front of the first counter tells.
+func sendsEnergy(b []byte, model meterModel) bool {
+	if !model.energy {
+		return false
+	}
+	for _, f := range model.totals {
+		if f.quantity == qEnergyForward {
+			return b[f.offset-3] == byte(f.channel()) && b[f.offset-2] == 8
+		}
+	}
+	return false
+}
+
+// rawValue reads the value of the first field of q from b as the meter sent it,
+// without scaling
+func rawValue(b []byte, fields []obisField, q quantity) uint64 {
+	for _, f := range fields {
+		if f.quantity != q {
+			continue
+		}
+		if f.size == 8 {
+			return binary.BigEndian.Uint64(b[f.offset : f.offset+8])
+		}
+		return uint64(binary.BigEndian.Uint32(b[f.offset : f.offset+4]))
+	}
+	return 0
+}
+
+// withoutEnergy returns fields without the energy counters
+func withoutEnergy(fields []obisField) []obisField {
+	var kept []obisField
+	for _, f := range fields {
+		if !f.quantity.isEnergy() {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// netEncodingSeen is set once a signed net value was decoded, to only log it once
+var netEncodingSeen bool
+
+// decodeFields reads all fields from b and returns the scaled values by quantity
+func decodeFields(b []byte, fields []obisField) fieldValues {
+	type pair struct {
+		buy, sell uint64
+		paired    bool // a selling half was read
+		size      int
+		scale     func(buy, sell uint64) float64
+	}
+	var pairs [numQuantities]pair
+	var values fieldValues
+	for _, f := range fields {
+		var v uint64
+		if f.size == 8 {
+			v = binary.BigEndian.Uint64(b[f.offset : f.offset+8])
+		} else {
+			v = uint64(binary.BigEndian.Uint32(b[f.offset : f.offset+4]))
+		}
+		p := &pairs[f.quantity]
+		if !values.sent[f.quantity] {
+			p.scale, p.size = f.scale, f.size
+			values.sent[f.quantity] = true
+		}
+		if f.sell {
+			p.sell, p.paired = v, true
+		} else {
+			p.buy = v
+		}
+	}
+
+	for q := range pairs {
+		if !values.sent[q] {
+			continue
+		}
+		p := &pairs[q]
+		if p.paired && p.sell == 0 && p.size == 4 && p.buy >= 1<<31 {
+			// Some firmware sends the net value, signed, in the buying half and leaves the
+			// selling one at 0. Unsigned this would be over 200 MW, so it can't be a real
+			// buying value.
+			if !netEncodingSeen {
+				log.Info("The meter sends signed net values instead of separate buy and sell ones")
+				netEncodingSeen = true
+			}
+			p.buy, p.sell = 0, 1<<32-p.buy
+		}
+		values.value[q] = p.scale(p.buy, p.sell)
+	}
+	return values
+}
+
+// fitsLayout tells whether every field of model has its OBIS code in front of it in b, as
+// far as b reaches. Only L1 is checked, the other phases follow it the same way.
+func fitsLayout(b []byte, model meterModel) bool {
+	for _, f := range model.totals {
+		if f.offset+f.size <= len(b) && !f.codeAt(b, f.offset, 0) {
+			return false
+		}
+	}
+	for _, f := range model.phase {
+		if at := model.phaseOffset + f.offset; at+f.size <= len(b) && !f.codeAt(b, at, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// codeAt tells whether the OBIS code of f, with obisShift added to its channel, is in
+// front of a value at offset of b
+func (f obisField) codeAt(b []byte, offset, obisShift int) bool {
+	return b[offset-3] == byte(f.channel()+obisShift) && b[offset-2] == byte(f.size)
+}
+
+// scanLayout finds the fields of model by their OBIS codes, for an update which has them
+// at other offsets, e.g. with entries in between which the model doesn't know. The
+// entries are read one by one from the first after the header, each a 4 byte OBIS code
+// with a value of the size the code gives. The version entry (0x90000000) or the end
+// marker ends them. Fields not found are left out, but the power has to be found
+// in the totals and L1, and the phase blocks have to hold all of their fields,
+// otherwise ok is false.
+func scanLayout(b []byte, model meterModel) (scanned meterModel, ok bool) {
+	// Offsets of the values by channel and size, 0 where none was found
+	var found [256][2]int
+	at := headerLen + 4
+	for at+4 <= len(b) {
+		code := binary.BigEndian.Uint32(b[at : at+4])
+		if code == 0 || code == 0x90000000 {
+			break
+		}
+		size := int(b[at+2])
+		if (size != 4 && size != 8) || at+4+size > len(b) {
+			break
+		}
+		found[b[at+1]][size/8] = at + 4
+		at += 4 + size
+	}
+	offset := func(f obisField, obisShift int) int {
+		return found[byte(f.channel()+obisShift)][f.size/8]
+	}
+
+	scanned = model
+	scanned.totals = nil
+	for _, f := range model.totals {
+		if f.offset = offset(f, 0); f.offset > 0 {
+			scanned.totals = append(scanned.totals, f)
+		} else if f.quantity == qPower {
+			return model, false
+		}
+	}
+
+	// The phase blocks start with their power bought, all of them laid out like L1
+	var first obisField
+	for _, f := range model.phase {
+		if f.quantity == qPower && !f.sell {
+			first = f
+		}
+	}
+	if offset(first, 0) == 0 {
+		return model, false
+	}
+	scanned.phaseOffset = offset(first, 0) - first.offset
+	if L2 := offset(first, 20); L2 > 0 {
+		scanned.phaseLen = L2 - offset(first, 0)
+	}
+	if scanned.phaseOffset < headerLen || scanned.phaseLen <= 0 {
+		// L2 in front of L1, or L1 in the header: nothing the phase blocks could be cut from
+		return model, false
+	}
+	scanned.phase = nil
+	for _, f := range model.phase {
+		if f.offset = offset(f, 0) - scanned.phaseOffset; f.offset > 0 {
+			if f.offset+f.size > scanned.phaseLen {
+				// Reaches into the next phase block, the blocks aren't laid out like L1
+				return model, false
+			}
+			scanned.phase = append(scanned.phase, f)
+		} else if f.quantity == qPower {
+			return model, false
+		}
+	}
+	scanned.versionOffset = at
+	return scanned, true
+}
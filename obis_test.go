@@ -0,0 +1,92 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestNetEncoding(t *testing.T) {
+	tests := []struct {
+		name      string
+		buy, sell uint32
+		power     float64
+		net       bool
+	}{
+		{"separate buying", 23456, 0, 2345.6, false},
+		{"separate selling", 0, 2500, -250, false},
+		{"net selling", 1<<32 - 2500, 0, -250, true},
+		// Up to 1<<31 it is still a buying value, from there on the signed net one
+		{"below the boundary", 1<<31 - 1, 0, 214748364.7, false},
+		{"at the boundary", 1 << 31, 0, -214748364.8, true},
+		// With something sold, the buying half is taken as it is
+		{"both halves", 1 << 31, 10, 214748363.8, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState(t)
+			b := make([]byte, phaseOffset)
+			binary.BigEndian.PutUint32(b[32:36], tt.buy)  // 1:1.4.0
+			binary.BigEndian.PutUint32(b[52:56], tt.sell) // 1:2.4.0
+			v := decodeFields(b, speedwireTotals)
+			if got := v.value[qPower]; !near(got, tt.power) {
+				t.Errorf("power %v, want %v", got, tt.power)
+			}
+			if netEncodingSeen != tt.net {
+				t.Errorf("net encoding detected: %v, want %v", netEncodingSeen, tt.net)
+			}
+		})
+	}
+}
+
+// entries builds an update of the given OBIS entries, each a channel and a 4 byte value
+// after the header of energy-meter.hex, padded with zeros to size
+func entries(t *testing.T, size int, channels ...int) []byte {
+	t.Helper()
+	b := make([]byte, size)
+	copy(b, loadFixture(t, "energy-meter.hex")[:headerLen+4])
+	at := headerLen + 4
+	for _, channel := range channels {
+		b[at+1], b[at+2] = byte(channel), 4
+		binary.BigEndian.PutUint32(b[at+4:], 1000)
+		at += 8
+	}
+	return b
+}
+
+func TestScanLayoutRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		channels []int
+	}{
+		// Total power bought and sold, then the phases' (21 and 22 for L1, 20 more per phase)
+		{"L2 in front of L1", []int{1, 2, 41, 42, 21, 22, 61, 62}},
+		// L1's voltage (32) comes after L3, far outside L1's block
+		{"phase blocks shorter than their fields", []int{1, 2, 21, 22, 41, 42, 61, 62, 32}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState(t)
+			b := entries(t, 700, tt.channels...)
+			if scanned, ok := scanLayout(b, speedwire); ok {
+				t.Errorf("layout accepted with phases at %d, %d bytes each", scanned.phaseOffset, scanned.phaseLen)
+			}
+			// Must not panic
+			decodeUpdate(b)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Captured datagrams are stored one after another, each as
+//
+//	8 bytes  receive time, unix nanoseconds
+//	4 bytes  datagram length n
+//	n bytes  datagram as received from the meter
+//
+// all big endian, the same as the meter itself.
+
+// capture wraps handler so every datagram is appended to the file at path before
+// being handed on
+func capture(path string, handler func(*net.UDPAddr, int, []byte)) func(*net.UDPAddr, int, []byte) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal("Could not open capture file: ", err)
+	}
+	log.Info("Capturing meter datagrams to ", path)
+
+	var mu sync.Mutex
+	return func(src *net.UDPAddr, n int, b []byte) {
+		var hdr [12]byte
+		binary.BigEndian.PutUint64(hdr[0:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint32(hdr[8:12], uint32(n))
+
+		mu.Lock()
+		if _, err := f.Write(append(hdr[:], b[:n]...)); err != nil {
+			log.Warn("Could not write captured datagram: ", err)
+		}
+		mu.Unlock()
+
+		handler(src, n, b)
+	}
+}
+
+// replay feeds all datagrams stored in the file at path to handler. With timing set,
+// it sleeps between datagrams as long as the meter did when they were captured. It
+// stops early once ctx is done.
+func replay(ctx context.Context, path string, timing bool, handler func(*net.UDPAddr, int, []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Info("Replaying meter datagrams from ", path)
+	r := bufio.NewReader(f)
+	var last int64
+	var b []byte
+	count := 0
+	for {
+		var hdr [12]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		ts := int64(binary.BigEndian.Uint64(hdr[0:8]))
+		n := int(binary.BigEndian.Uint32(hdr[8:12]))
+		if n > maxDatagramSize {
+			// No meter sends this much, the file is broken or not a capture
+			return fmt.Errorf("datagram %d is %d bytes, more than the %d a meter sends", count+1, n, maxDatagramSize)
+		}
+
+		if cap(b) < n {
+			b = make([]byte, n)
+		}
+		b = b[:n]
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+
+		if timing && last != 0 && ts > last {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Duration(ts - last)):
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		last = ts
+
+		handler(nil, n, b)
+		count++
+	}
+	log.Info("Replayed ", count, " datagrams")
+	return nil
+}
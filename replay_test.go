@@ -0,0 +1,62 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCapture writes datagrams to a capture file as CAPTURE_FILE does, each with its
+// receive time
+func writeCapture(t *testing.T, datagrams [][]byte, at []time.Time) string {
+	t.Helper()
+	var data []byte
+	for i, b := range datagrams {
+		data = binary.BigEndian.AppendUint64(data, uint64(at[i].UnixNano()))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(b)))
+		data = append(data, b...)
+	}
+	path := filepath.Join(t.TempDir(), "capture")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplayCancel(t *testing.T) {
+	resetState(t)
+	b := loadFixture(t, "energy-meter.hex")
+	// With timing, the second datagram is an hour away
+	now := time.Now()
+	path := writeCapture(t, [][]byte{b, b}, []time.Time{now, now.Add(time.Hour)})
+
+	started := make(chan struct{})
+	handled := 0
+	returnsOnCancel(t, started, func(ctx context.Context) error {
+		return replay(ctx, path, true, func(*net.UDPAddr, int, []byte) {
+			handled++
+			close(started)
+		})
+	})
+	if handled != 1 {
+		t.Errorf("%d datagrams handled, want 1", handled)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// Paths of the session energy, counted by integrating the power since the start or the
+// last reset, independent of the meter's own counters
+const (
+	sessionForwardPath = "/Ac/Energy/SessionForward"
+	sessionReversePath = "/Ac/Energy/SessionReverse"
+	sessionResetPath   = "/Ac/Energy/SessionReset"
+)
+
+// The integrated energy, never reset, is compared against how much the meter's counters
+// grew over the same time, to catch counters which are decoded or scaled wrongly
+const (
+	integratedForwardPath = "/Debug/Energy/IntegratedForward"
+	integratedReversePath = "/Debug/Energy/IntegratedReverse"
+)
+
+// The check starts once the meter counted this much, below it the counters' resolution
+// and the first update's timing would dominate
+const energyCheckMin = 0.5 // kWh
+
+// Longer gaps between updates aren't integrated, nobody knows what flowed meanwhile
+const sessionMaxGap = 10 * time.Second
+
+var (
+	sessionMu      sync.Mutex
+	sessionForward float64 // kWh
+	sessionReverse float64 // kWh
+	sessionPower   float32 // W of the last update
+	sessionLast    uint32  // clock of the last update, see meterClock
+	sessionStarted bool    // an update was integrated, sessionLast is set
+
+	integratedForward, integratedReverse float64 // kWh since the start
+	meterForwardStart, meterReverseStart float64 // meter counters of the first update
+	meterForwardLast, meterReverseLast   float64
+	sessionGap                           bool // an update came too late to integrate
+	energyDiverged                       bool
+)
+
+// startedAt is when the program started, the clock of updates without one of their own
+var startedAt = time.Now()
+
+// meterClock is the time of an update in ms, for integrating the power over. It is the
+// meter's own millisecond counter, so the time between updates isn't stretched by a busy
+// host or squeezed by a replay without timing. Modbus readings have none and go by ours.
+func meterClock(uptime time.Duration) uint32 {
+	if uptime == 0 {
+		return uint32(time.Since(startedAt) / time.Millisecond)
+	}
+	return uint32(uptime / time.Millisecond)
+}
+
+// integrateSession adds what flowed since the last update to the session energy, taking
+// the power as changing linearly in between. at is the update's meterClock; the counter
+// wrapping is taken care of, a meter restart looks like a gap.
+func integrateSession(power float32, at uint32) {
+	sessionMu.Lock()
+	elapsed := time.Duration(at-sessionLast) * time.Millisecond
+	if sessionStarted && elapsed > sessionMaxGap {
+		sessionGap = true
+	}
+	if dt := elapsed.Hours(); sessionStarted && dt > 0 && elapsed <= sessionMaxGap {
+		p0, p1 := float64(sessionPower), float64(power)
+		if (p0 < 0) != (p1 < 0) && p0 != p1 {
+			// Split at the zero crossing, what was sold must not cancel what was bought
+			t := p0 / (p0 - p1)
+			sessionAdd(p0 / 2 * t * dt)
+			sessionAdd(p1 / 2 * (1 - t) * dt)
+		} else {
+			sessionAdd((p0 + p1) / 2 * dt)
+		}
+	}
+	sessionPower, sessionLast, sessionStarted = power, at, true
+	forward, reverse := sessionForward, sessionReverse
+	intForward, intReverse := integratedForward, integratedReverse
+	sessionMu.Unlock()
+
+	updateVariant(forward, "kWh", sessionForwardPath)
+	updateVariant(reverse, "kWh", sessionReversePath)
+	updateVariant(intForward, "kWh", integratedForwardPath)
+	updateVariant(intReverse, "kWh", integratedReversePath)
+}
+
+// checkIntegrated warns when the meter's counters grew by more than ENERGY_CHECK_PERCENT
+// more or less than the integrated power since the start
+func checkIntegrated(forward, reverse float64) {
+	if cfg.EnergyCheckPercent <= 0 {
+		return
+	}
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if meterForwardStart == 0 && meterReverseStart == 0 {
+		meterForwardStart, meterReverseStart = forward, reverse
+		meterForwardLast, meterReverseLast = forward, reverse
+		return
+	}
+	if sessionGap {
+		// Nothing was integrated over the gap, so leave out what the meter counted in it
+		meterForwardStart += forward - meterForwardLast
+		meterReverseStart += reverse - meterReverseLast
+		sessionGap = false
+	}
+	meterForwardLast, meterReverseLast = forward, reverse
+
+	diverged := false
+	for _, c := range []struct {
+		name              string
+		meter, integrated float64
+	}{
+		{"bought", forward - meterForwardStart, integratedForward},
+		{"sold", reverse - meterReverseStart, integratedReverse},
+	} {
+		if c.meter < energyCheckMin {
+			continue
+		}
+		off := math.Abs(c.integrated-c.meter) / c.meter * 100
+		if off <= cfg.EnergyCheckPercent {
+			continue
+		}
+		diverged = true
+		if !energyDiverged {
+			log.Warnf("The meter counted %.3f kWh %s since the start, but its power adds up to %.3f kWh (%.0f%% off), the energy counters may be decoded wrongly",
+				c.meter, c.name, c.integrated, off)
+		}
+	}
+	if energyDiverged && !diverged {
+		log.Info("The meter's energy counters agree with its power again")
+	}
+	energyDiverged = diverged
+}
+
+// sessionAdd books wh to bought or sold by its sign, in kWh. sessionMu must be held.
+func sessionAdd(wh float64) {
+	if wh > 0 {
+		sessionForward += wh / 1000
+		integratedForward += wh / 1000
+	} else {
+		sessionReverse -= wh / 1000
+		integratedReverse -= wh / 1000
+	}
+}
+
+// resetSession starts the session energy from 0
+func resetSession() {
+	sessionMu.Lock()
+	sessionForward, sessionReverse = 0, 0
+	sessionMu.Unlock()
+	log.Info("Session energy reset")
+
+	updateVariant(0, "kWh", sessionForwardPath)
+	updateVariant(0, "kWh", sessionReversePath)
+	takeSnapshot()
+	flushItems()
+}
+
+// SetValue is only accepted on sessionResetPath, where any value resets the session
+// energy. Like the Victron services, it answers 0 when done and 1 for read-only paths.
+func (f objectpath) SetValue(value dbus.Variant) (int32, *dbus.Error) {
+	log.Debug("SetValue(", value, ") called for ", f)
+	if f != sessionResetPath {
+		return 1, nil
+	}
+	resetSession()
+	return 0, nil
+}
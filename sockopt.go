@@ -0,0 +1,55 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastOptions applies MULTICAST_LOOP and MULTICAST_TTL to c, leaving the system
+// defaults where they aren't set. Loopback decides whether datagrams sent on this host
+// reach listeners on it too, the TTL how many routers, e.g. smcroute relaying the meter
+// into another subnet, what is sent may cross. Both only change what c sends.
+func setMulticastOptions(c *net.UDPConn, ipv6 bool) error {
+	level, loopOpt, ttlOpt := syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, syscall.IP_MULTICAST_TTL
+	if ipv6 {
+		level, loopOpt, ttlOpt = syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, syscall.IPV6_MULTICAST_HOPS
+	}
+
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		if cfg.MulticastLoop != nil {
+			loop := 0
+			if *cfg.MulticastLoop {
+				loop = 1
+			}
+			if opErr = setsockoptInt(fd, level, loopOpt, loop); opErr != nil {
+				return
+			}
+		}
+		if cfg.MulticastTTL > 0 {
+			opErr = setsockoptInt(fd, level, ttlOpt, cfg.MulticastTTL)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,130 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// datagramStats counts what happened to the datagrams received. They are only
+// touched with sync/atomic, so msgHandler doesn't need to take a lock for them.
+// Keep the fields uint64 only, 32 bit ARM needs them 64 bit aligned.
+type datagramStats struct {
+	received uint64 // everything handed to msgHandler
+	filtered uint64 // not a meter update, or from a meter we don't follow
+	short    uint64 // too short for the header or all phases
+	rejected uint64 // energy counter values left out as implausible
+	decoded  uint64 // published
+}
+
+var stats datagramStats
+
+// count increments one of the counters in stats
+func count(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// snapshot reads all counters
+func (s *datagramStats) snapshot() datagramStats {
+	return datagramStats{
+		received: atomic.LoadUint64(&s.received),
+		filtered: atomic.LoadUint64(&s.filtered),
+		short:    atomic.LoadUint64(&s.short),
+		rejected: atomic.LoadUint64(&s.rejected),
+		decoded:  atomic.LoadUint64(&s.decoded),
+	}
+}
+
+// latencyBuckets are the upper bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25}
+
+// latency collects how long a step of handling a meter update takes
+type latency struct {
+	mu       sync.Mutex
+	buckets  []uint64 // per bound in latencyBuckets, not cumulative
+	count    uint64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+// Decoding is everything in msgHandler up to the reading, publishing everything after it,
+// dbus signals included
+var decodeLatency, publishLatency latency
+
+func (l *latency) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if d.Seconds() <= bound {
+			l.buckets[i]++
+			break
+		}
+	}
+	if l.count == 0 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	l.count++
+	l.sum += d
+}
+
+// writeHistogram writes l in the prometheus text format
+func (l *latency) writeHistogram(w io.Writer, name, help string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		if l.buckets != nil {
+			cumulative += l.buckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, l.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, l.sum.Seconds(), name, l.count)
+}
+
+// String is the min/avg/max for the log
+func (l *latency) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count == 0 {
+		return "none yet"
+	}
+	return fmt.Sprintf("min %s, avg %s, max %s", l.min, l.sum/time.Duration(l.count), l.max)
+}
+
+// logStats logs the counters every interval, to see at a glance whether updates are
+// getting lost without turning on debug logging
+func logStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		s := stats.snapshot()
+		log.Infof("Datagrams so far: %d received, %d filtered, %d too short, %d decoded, %d implausible energy values",
+			s.received, s.filtered, s.short, s.decoded, s.rejected)
+		log.Debugf("Time per meter update: decoding %s; publishing %s", &decodeLatency, &publishLatency)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type statusValue struct {
+	Value interface{} `json:"value"`
+	Text  string      `json:"text"`
+}
+
+type status struct {
+	Serial      uint32                 `json:"serial"`
+	SusyID      uint16                 `json:"susy_id"`
+	Model       string                 `json:"model"`
+	LastPacket  *time.Time             `json:"last_packet"`
+	PacketCount uint64                 `json:"packet_count"`
+	Connected   bool                   `json:"connected"`
+	Values      map[string]statusValue `json:"values"`
+}
+
+// serveStatus answers GET /status on addr with everything currently published on
+// dbus, for debugging without tailing the log. It only returns if the listener fails.
+func serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	log.Info("Serving status on ", addr, "/status")
+	log.Error("Status server stopped: ", http.ListenAndServe(addr, mux))
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	st := status{Values: map[string]statusValue{}}
+	valuesMu.RLock()
+	st.Serial = meterSerial
+	st.SusyID = meterSusyID
+	if meterSerial != 0 {
+		st.Model = describeModel(meterSusyID)
+	}
+	st.PacketCount = packetCount
+	st.Connected = connected
+	if !lastPacket.IsZero() {
+		t := lastPacket
+		st.LastPacket = &t
+	}
+	valuesMu.RUnlock()
+	for p, it := range snapshotItems() {
+		st.Values[p] = statusValue{Value: it.value, Text: it.text}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(st); err != nil {
+		log.Debug("Could not write status: ", err)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "sync"
+
+// The lowest and highest power of every phase since the start, published below
+// /Debug/Ac/Lx/ to size inverters and to catch spikes between two looks at the GUI
+var (
+	watermarkMu        sync.Mutex
+	powerMin, powerMax = map[int]float64{}, map[int]float64{} // W, by phase index
+)
+
+// watermarkPath is the dbus path of a watermark, e.g. /Debug/Ac/L1/PowerMax
+func watermarkPath(phase, name string) string {
+	return "/Debug/Ac/" + phase + "/" + name
+}
+
+// updateWatermarks takes the power of every phase into their watermarks and publishes
+// those which moved
+func updateWatermarks(phases []singlePhase) {
+	hi, lo := "PowerMax", "PowerMin"
+	if cfg.InvertPower {
+		// Published negated, the lowest power is the highest one published
+		hi, lo = lo, hi
+	}
+
+	for i, L := range phases {
+		p := float64(L.power)
+		watermarkMu.Lock()
+		min, seen := powerMin[i]
+		max := powerMax[i]
+		newMin, newMax := !seen || p < min, !seen || p > max
+		if newMin {
+			powerMin[i], min = p, p
+		}
+		if newMax {
+			powerMax[i], max = p, p
+		}
+		watermarkMu.Unlock()
+
+		if newMin {
+			updateVariant(min, "W", watermarkPath(phaseNames[i], lo))
+		}
+		if newMax {
+			updateVariant(max, "W", watermarkPath(phaseNames[i], hi))
+		}
+	}
+}